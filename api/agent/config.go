@@ -1,7 +1,12 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -10,6 +15,8 @@ import (
 	"github.com/hashicorp/hcl/hcl/ast"
 	"github.com/hashicorp/hcl/hcl/token"
 	"github.com/pkg/errors"
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 
 	"github.com/spiffe/tornjak/pkg/agent/authentication/authenticator"
 	"github.com/spiffe/tornjak/pkg/agent/authorization"
@@ -118,6 +125,287 @@ func NewCRDManager(crdPlugin *ast.ObjectItem) (spirecrd.CRDManager, error) {
 	return crdManager, nil
 }
 
+// parseDuration parses an optional duration field from config
+// an empty value is returned as zero so that defaults apply
+func parseDuration(field string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Errorf("Invalid duration for %s: %v", field, err)
+	}
+	return d, nil
+}
+
+// envReference matches the ${ENV_VAR} references expanded in secret fields
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveSecret resolves a sensitive field from config so that secrets need
+// not be committed with it: ${ENV_VAR} references are replaced by the value
+// of the environment variable, then a value of the form file:/path is
+// replaced by the content of the file, without trailing newlines. Missing
+// variables and unreadable files are errors.
+func resolveSecret(field string, value string) (string, error) {
+	var err error
+	value = envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = errors.Errorf("%s: environment variable %s is not set", field, name)
+		}
+		return env
+	})
+	if err != nil {
+		return "", err
+	}
+	if path, ok := strings.CutPrefix(value, "file:"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", errors.Errorf("%s: could not read secret file: %v", field, err)
+		}
+		value = strings.TrimRight(string(content), "\r\n")
+	}
+	return value, nil
+}
+
+// newJWKSConfig converts the jwks config section into an authenticator.JWKSConfig
+func newJWKSConfig(config *jwksConfig) (authenticator.JWKSConfig, error) {
+	jwksConfig := authenticator.JWKSConfig{}
+	if config == nil {
+		return jwksConfig, nil
+	}
+	var err error
+	if jwksConfig.RefreshInterval, err = parseDuration("jwks > refresh_interval", config.RefreshInterval); err != nil {
+		return jwksConfig, err
+	}
+	if jwksConfig.RefreshRateLimit, err = parseDuration("jwks > refresh_rate_limit", config.RefreshRateLimit); err != nil {
+		return jwksConfig, err
+	}
+	if jwksConfig.RefreshTimeout, err = parseDuration("jwks > refresh_timeout", config.RefreshTimeout); err != nil {
+		return jwksConfig, err
+	}
+	if jwksConfig.UnhealthyAfter, err = parseDuration("jwks > unhealthy_after", config.UnhealthyAfter); err != nil {
+		return jwksConfig, err
+	}
+	if jwksConfig.RetryInitialInterval, err = parseDuration("jwks > retry_initial_interval", config.RetryInitialInterval); err != nil {
+		return jwksConfig, err
+	}
+	if jwksConfig.RetryMaxInterval, err = parseDuration("jwks > retry_max_interval", config.RetryMaxInterval); err != nil {
+		return jwksConfig, err
+	}
+	jwksConfig.RetryJitter = config.RetryJitter
+	jwksConfig.RefreshUnknownKID = config.RefreshUnknownKID
+	jwksConfig.DisableRefresh = config.DisableRefresh
+	jwksConfig.RespectCacheHeaders = config.RespectCacheHeaders
+	jwksConfig.AllowEmpty = config.AllowEmpty
+	return jwksConfig, nil
+}
+
+// mergeAudiences combines audience and audiences into one list of accepted values
+func mergeAudiences(audience string, audiences []string) []string {
+	if audience != "" {
+		return append([]string{audience}, audiences...)
+	}
+	return audiences
+}
+
+// warnMissingAudience logs a warning if no audience is configured for an
+// issuer, as the aud claim of its tokens is then not checked
+func warnMissingAudience(issuer string, audiences []string) {
+	if len(audiences) == 0 {
+		fmt.Printf("WARNING: Auth plugin has no expected audience configured for issuer '%s' - `aud` claim will not be checked (please populate 'config > plugins > UserManagement KeycloakAuth > plugin_data > audience')\n", issuer)
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newAuthTLSConfig(config *authTLSConfig) (authenticator.TLSConfig, error) {
+	if config == nil {
+		return authenticator.TLSConfig{}, nil
+	}
+	caPEM, err := resolveSecret("tls > ca_pem", config.CAPEM)
+	if err != nil {
+		return authenticator.TLSConfig{}, err
+	}
+	tlsConfig := authenticator.TLSConfig{
+		CAFile: config.CAFile,
+		CAPEM:  []byte(caPEM),
+	}
+	if config.MinVersion != "" {
+		minVersion, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return authenticator.TLSConfig{}, errors.Errorf("tls > min_version: unknown TLS version %q", config.MinVersion)
+		}
+		tlsConfig.MinVersion = minVersion
+	}
+	return tlsConfig, nil
+}
+
+// newPublicKeys reads public_key blocks, each setting exactly one of pem
+// and pem_file
+func newPublicKeys(config []*publicKey) ([]authenticator.PublicKeyPEM, error) {
+	publicKeys := make([]authenticator.PublicKeyPEM, 0, len(config))
+	for _, key := range config {
+		if (key.PEM == "") == (key.PEMFile == "") {
+			return nil, errors.Errorf("public_key %q: exactly one of pem and pem_file is required", key.KID)
+		}
+		pem := []byte(key.PEM)
+		if key.PEMFile != "" {
+			var err error
+			pem, err = os.ReadFile(key.PEMFile)
+			if err != nil {
+				return nil, errors.Errorf("public_key %q: %v", key.KID, err)
+			}
+		}
+		publicKeys = append(publicKeys, authenticator.PublicKeyPEM{KID: key.KID, PEM: pem})
+	}
+	return publicKeys, nil
+}
+
+func newSPIFFEIDRoleMappings(config []*spiffeIDRoles) []authenticator.SPIFFEIDRoleMapping {
+	roleMappings := make([]authenticator.SPIFFEIDRoleMapping, 0, len(config))
+	for _, mapping := range config {
+		roleMappings = append(roleMappings, authenticator.SPIFFEIDRoleMapping{
+			Pattern: mapping.Pattern,
+			Roles:   mapping.Roles,
+		})
+	}
+	return roleMappings
+}
+
+// keycloakAuthenticator is implemented by the authenticators configured by
+// the Keycloak plugin
+type keycloakAuthenticator interface {
+	authenticator.Authenticator
+	WatchRoleMappingsFile(path string) error
+}
+
+// newKeycloakAuthenticator creates the authenticator matching the way the
+// Keycloak plugin obtains keys: several realms, static public keys, a JWKS
+// file or Kubernetes Secret, an HMAC secret or, by default, OIDC discovery
+func newKeycloakAuthenticator(config pluginAuthenticatorKeycloak, keycloakConfig authenticator.KeycloakConfig, audiences []string) (keycloakAuthenticator, error) {
+	// realm blocks add issuers validated by their own discovered JWKS
+	if len(config.Realms) > 0 {
+		if config.HMACSecret != "" || config.JWKSFile != "" || config.JWKSSecret != nil || config.JWKSURL != "" || len(config.JWKSURLs) > 0 || len(config.PublicKeys) > 0 {
+			return nil, errors.New("Couldn't parse Authenticator config: realm blocks cannot be combined with hmac_secret, jwks_file, jwks_secret, jwks_url, jwks_urls or public_key")
+		}
+		issuers := []authenticator.IssuerConfig{}
+		if config.IssuerURL != "" {
+			issuers = append(issuers, authenticator.IssuerConfig{
+				IssuerURL: config.IssuerURL,
+				Issuer:    config.ExpectedIssuer,
+				Audiences: audiences,
+			})
+		}
+		for _, realm := range config.Realms {
+			realmAudiences := mergeAudiences(realm.Audience, realm.Audiences)
+			warnMissingAudience(realm.IssuerURL, realmAudiences)
+			issuers = append(issuers, authenticator.IssuerConfig{
+				IssuerURL: realm.IssuerURL,
+				Issuer:    realm.ExpectedIssuer,
+				Audiences: realmAudiences,
+			})
+		}
+		authenticator, err := authenticator.NewMultiIssuerAuthenticator(context.Background(), true, keycloakConfig, issuers)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// static public keys replace OIDC discovery for issuers publishing no JWKS
+	if len(config.PublicKeys) > 0 {
+		if config.HMACSecret != "" || config.JWKSFile != "" || config.JWKSSecret != nil || config.JWKSURL != "" || len(config.JWKSURLs) > 0 {
+			return nil, errors.New("Couldn't parse Authenticator config: public_key blocks cannot be combined with hmac_secret, jwks_file, jwks_secret, jwks_url or jwks_urls")
+		}
+		publicKeys, err := newPublicKeys(config.PublicKeys)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		authenticator, err := authenticator.NewKeycloakAuthenticatorWithPublicKeys(publicKeys, keycloakConfig)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// JWKS URLs tried in order replace OIDC discovery for highly available issuers
+	if len(config.JWKSURLs) > 0 {
+		if config.HMACSecret != "" || config.JWKSFile != "" || config.JWKSSecret != nil || config.JWKSURL != "" {
+			return nil, errors.New("Couldn't parse Authenticator config: jwks_urls cannot be combined with hmac_secret, jwks_file, jwks_secret or jwks_url")
+		}
+		authenticator, err := authenticator.NewKeycloakAuthenticatorWithJWKSURLs(config.JWKSURLs, keycloakConfig)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// a known JWKS URL skips OIDC discovery
+	if config.JWKSURL != "" {
+		if config.HMACSecret != "" || config.JWKSFile != "" || config.JWKSSecret != nil {
+			return nil, errors.New("Couldn't parse Authenticator config: jwks_url cannot be combined with hmac_secret, jwks_file or jwks_secret")
+		}
+		authenticator, err := authenticator.NewKeycloakAuthenticatorWithJWKS(config.JWKSURL, keycloakConfig)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// a local JWKS file replaces OIDC discovery, e.g. in air-gapped environments
+	if config.JWKSFile != "" {
+		if config.HMACSecret != "" || config.JWKSSecret != nil {
+			return nil, errors.New("Couldn't parse Authenticator config: jwks_file cannot be combined with hmac_secret or jwks_secret")
+		}
+		authenticator, err := authenticator.NewKeycloakAuthenticatorWithJWKSFile(config.JWKSFile, config.WatchJWKSFile, keycloakConfig)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// a Kubernetes Secret holding the JWKS replaces OIDC discovery where
+	// keys are distributed as Secrets
+	if config.JWKSSecret != nil {
+		if config.HMACSecret != "" {
+			return nil, errors.New("Couldn't parse Authenticator config: jwks_secret cannot be combined with hmac_secret")
+		}
+		secret := authenticator.SecretRef{
+			Namespace: config.JWKSSecret.Namespace,
+			Name:      config.JWKSSecret.Name,
+			Key:       config.JWKSSecret.Key,
+		}
+		authenticator, err := authenticator.NewKeycloakAuthenticatorWithJWKSSecret(context.Background(), secret, config.JWKSSecret.Watch, keycloakConfig)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// a shared secret selects HS256 validation instead of OIDC discovery
+	if config.HMACSecret != "" {
+		authenticator, err := authenticator.NewKeycloakAuthenticatorWithHMAC([]byte(config.HMACSecret), keycloakConfig)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	}
+
+	// create authenticator TODO make json an option?
+	authenticator, err := authenticator.NewKeycloakAuthenticator(context.Background(), true, keycloakConfig)
+	if err != nil {
+		return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+	}
+	return authenticator, nil
+}
+
 // NewAuthenticator returns a new Authenticator
 func NewAuthenticator(authenticatorPlugin *ast.ObjectItem) (authenticator.Authenticator, error) {
 	key, data, _ := getPluginConfig(authenticatorPlugin)
@@ -134,14 +422,287 @@ func NewAuthenticator(authenticatorPlugin *ast.ObjectItem) (authenticator.Authen
 		if err := hcl.DecodeObject(&config, data); err != nil {
 			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
 		}
+		hmacSecret, err := resolveSecret("hmac_secret", config.HMACSecret)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		config.HMACSecret = hmacSecret
+
+		audiences := mergeAudiences(config.Audience, config.Audiences)
+		if config.IssuerURL != "" || config.HMACSecret != "" || config.JWKSFile != "" || config.JWKSSecret != nil || config.JWKSURL != "" || len(config.JWKSURLs) > 0 || len(config.PublicKeys) > 0 {
+			warnMissingAudience(config.IssuerURL, audiences)
+		}
+
+		jwksConfig, err := newJWKSConfig(config.JWKS)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		leeway, err := parseDuration("leeway", config.Leeway)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		maxTokenAge, err := parseDuration("max_token_age", config.MaxTokenAge)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		minRemainingTTL, err := parseDuration("min_remaining_ttl", config.MinRemainingTTL)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		roleCacheTTL, err := parseDuration("role_cache_ttl", config.RoleCacheTTL)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		userInfoCacheTTL, err := parseDuration("userinfo_cache_ttl", config.UserInfoCacheTTL)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		discoveryRefreshInterval, err := parseDuration("discovery_refresh_interval", config.DiscoveryRefresh)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		discoveryCacheMaxAge, err := parseDuration("discovery_cache_max_age", config.DiscoveryCacheMaxAge)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		tlsConfig, err := newAuthTLSConfig(config.TLS)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		transportConfig := authenticator.TransportConfig{}
+		if config.Transport != nil {
+			transportConfig.MaxIdleConns = config.Transport.MaxIdleConns
+			transportConfig.MaxIdleConnsPerHost = config.Transport.MaxIdleConnsPerHost
+			transportConfig.ForceHTTP2 = config.Transport.ForceHTTP2
+			transportConfig.IdleConnTimeout, err = parseDuration("transport > idle_conn_timeout", config.Transport.IdleConnTimeout)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+			}
+		}
+		discoveryRetryConfig := authenticator.DiscoveryRetryConfig{}
+		if config.DiscoveryRetry != nil {
+			discoveryRetryConfig.MaxAttempts = config.DiscoveryRetry.MaxAttempts
+			discoveryRetryConfig.MaxElapsedTime, err = parseDuration("discovery_retry > max_elapsed_time", config.DiscoveryRetry.MaxElapsedTime)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+			}
+		}
+
+		rolePatterns := make([]authenticator.RolePatternMapping, 0, len(config.RolePatterns))
+		for _, rolePattern := range config.RolePatterns {
+			rolePatterns = append(rolePatterns, authenticator.RolePatternMapping{
+				Pattern: rolePattern.Pattern,
+				Role:    rolePattern.Role,
+			})
+		}
 
-		// Log warning if audience is nil that aud claim is not checked
-		if config.Audience == "" {
-			fmt.Println("WARNING: Auth plugin has no expected audience configured - `aud` claim will not be checked (please populate 'config > plugins > UserManagement KeycloakAuth > plugin_data > audience')")
+		groupMappings := make([]authenticator.GroupMapping, 0, len(config.GroupMappings))
+		for _, groupMapping := range config.GroupMappings {
+			groupMappings = append(groupMappings, authenticator.GroupMapping{
+				Group: groupMapping.Group,
+				Match: authenticator.GroupMatch(groupMapping.Match),
+				Role:  groupMapping.Role,
+			})
 		}
 
-		// create authenticator TODO make json an option?
-		authenticator, err := authenticator.NewKeycloakAuthenticator(true, config.IssuerURL, config.Audience)
+		var tenantRoleMappings map[string]map[string]string
+		for _, tenant := range config.Tenants {
+			if _, ok := tenantRoleMappings[tenant.Name]; ok {
+				return nil, errors.Errorf("Couldn't parse Authenticator config: tenant %q is configured more than once", tenant.Name)
+			}
+			if tenantRoleMappings == nil {
+				tenantRoleMappings = map[string]map[string]string{}
+			}
+			tenantRoleMappings[tenant.Name] = tenant.RoleMappings
+		}
+
+		keycloakConfig := authenticator.KeycloakConfig{
+			IssuerURL:                config.IssuerURL,
+			Issuer:                   config.ExpectedIssuer,
+			TLS:                      tlsConfig,
+			Transport:                transportConfig,
+			AllowInsecure:            config.AllowInsecure,
+			DiscoveryRetry:           discoveryRetryConfig,
+			DiscoveryRefreshInterval: discoveryRefreshInterval,
+			DiscoveryCacheFile:       config.DiscoveryCacheFile,
+			DiscoveryCacheMaxAge:     discoveryCacheMaxAge,
+			Audiences:                audiences,
+			EnforceAudience:          config.EnforceAudience,
+			AuthorizedParty:          config.AuthorizedParty,
+			RequiredTokenType:        config.RequiredTokenType,
+			JWKS:                     jwksConfig,
+			RoleMappings:             config.RoleMappings,
+			RolePrefix:               config.RolePrefix,
+			CompositeRoles:           config.CompositeRoles,
+			ScopeMappings:            config.ScopeMappings,
+			RolePatternMappings:      rolePatterns,
+			GroupMappings:            groupMappings,
+			GroupsClaim:              config.GroupsClaim,
+			RequireMappedRole:        config.RequireMappedRole,
+			SingleUseRoles:           config.SingleUseRoles,
+			RolesClaim:               config.RolesClaim,
+			RolesClientID:            config.RolesClientID,
+			Leeway:                   leeway,
+			MaxTokenAge:              maxTokenAge,
+			MinRemainingTTL:          minRemainingTTL,
+			TokenCookieName:          config.TokenCookie,
+			TokenFormField:           config.TokenFormField,
+			TokenQueryParameter:      config.TokenQueryParameter,
+			TokenQueryPaths:          config.TokenQueryPaths,
+			TokenHeader:              config.TokenHeader,
+			TokenSchemes:             config.TokenSchemes,
+			DisableTokenCache:        config.DisableTokenCache,
+			RoleCacheTTL:             roleCacheTTL,
+			TenantClaim:              config.TenantClaim,
+			TenantRoleMappings:       tenantRoleMappings,
+			UserInfoRoles:            config.UserInfoRoles,
+			UserInfoCacheTTL:         userInfoCacheTTL,
+			AllowedNetworks:          config.AllowedNetworks,
+			TrustedProxyHops:         config.TrustedProxyHops,
+			NetworkRestrictedRoles:   config.NetworkRestrictedRoles,
+			AllowedAlgorithms:        config.AllowedAlgorithms,
+			AllowedKIDs:              config.AllowedKIDs,
+			HostAudiences:            config.HostAudiences,
+			RequireEncryption:        config.RequireEncryption,
+			RequireEmailVerified:     config.RequireEmailVerified,
+		}
+		// authentication outcomes are counted for the /metrics route
+		if config.Metrics {
+			keycloakConfig.Metrics = authenticator.NewMetrics()
+		}
+		// encrypted tokens are decrypted with an RSA private key
+		if config.DecryptionKeyFile != "" {
+			pem, err := os.ReadFile(config.DecryptionKeyFile)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't configure Authenticator: could not read decryption_key_file: %v", err)
+			}
+			keycloakConfig.DecryptionKey, err = authenticator.ParseDecryptionKeyPEM(pem)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't configure Authenticator: decryption_key_file: %v", err)
+			}
+		}
+		// the login flow uses the endpoints found by OIDC discovery
+		if config.Login != nil {
+			if len(config.Realms) > 0 || len(config.PublicKeys) > 0 || config.JWKSURL != "" || len(config.JWKSURLs) > 0 || config.JWKSFile != "" || config.JWKSSecret != nil || config.HMACSecret != "" {
+				return nil, errors.New("Couldn't parse Authenticator config: login cannot be combined with realm, public_key, jwks_url, jwks_urls, jwks_file, jwks_secret or hmac_secret")
+			}
+			clientSecret, err := resolveSecret("login > client_secret", config.Login.ClientSecret)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+			}
+			keycloakConfig.Login = &authenticator.LoginConfig{
+				ClientID:      config.Login.ClientID,
+				ClientSecret:  clientSecret,
+				RedirectURL:   config.Login.RedirectURL,
+				Scopes:        config.Login.Scopes,
+				PostLoginURL:  config.Login.PostLoginURL,
+				PostLogoutURL: config.Login.PostLogoutURL,
+			}
+		}
+
+		if config.RoleMappingsFile != "" && len(config.RoleMappings) > 0 {
+			return nil, errors.New("Couldn't parse Authenticator config: role_mappings_file cannot be combined with role_mappings")
+		}
+		// authentication decisions are appended to the audit log as JSON
+		// lines; the file is opened last, and closed with the authenticator,
+		// or here if none could be created
+		if config.AuditLog != "" {
+			keycloakConfig.AuditSink, err = authenticator.OpenJSONAuditLog(config.AuditLog)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't configure Authenticator: audit_log: %v", err)
+			}
+		}
+		keycloak, err := newKeycloakAuthenticator(config, keycloakConfig, audiences)
+		if err != nil {
+			if closer, ok := keycloakConfig.AuditSink.(io.Closer); ok {
+				closer.Close()
+			}
+			return nil, err
+		}
+		// role mappings read from a file are reloaded when it changes or on SIGHUP
+		if config.RoleMappingsFile != "" {
+			if err := keycloak.WatchRoleMappingsFile(config.RoleMappingsFile); err != nil {
+				keycloak.Close()
+				return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+			}
+		}
+		return keycloak, nil
+	case "Null":
+		// plugin_data is optional, roles default to admin
+		var config pluginAuthenticatorNull
+		if data != nil {
+			if err := hcl.DecodeObject(&config, data); err != nil {
+				return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+			}
+		}
+		return authenticator.NewNullAuthenticator(config.Roles, nil), nil
+	case "JWTSVID":
+		// check if data is defined
+		if data == nil {
+			return nil, errors.New("JWTSVID Authenticator plugin ('config > plugins > Authenticator JWTSVID > plugin_data') not populated")
+		}
+		var config pluginAuthenticatorJWTSVID
+		if err := hcl.DecodeObject(&config, data); err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+
+		trustDomain, err := spiffeid.TrustDomainFromString(config.TrustDomain)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: trust_domain: %v", err)
+		}
+		bundle, err := spiffebundle.Load(trustDomain, config.BundleFile)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: bundle_file: %v", err)
+		}
+		authenticator, err := authenticator.NewJWTSVIDAuthenticator(authenticator.JWTSVIDConfig{
+			Bundles:      bundle,
+			Audiences:    mergeAudiences(config.Audience, config.Audiences),
+			RoleMappings: newSPIFFEIDRoleMappings(config.RoleMappings),
+		})
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	case "Introspection":
+		// check if data is defined
+		if data == nil {
+			return nil, errors.New("Introspection Authenticator plugin ('config > plugins > Authenticator Introspection > plugin_data') not populated")
+		}
+		var config pluginAuthenticatorIntrospection
+		if err := hcl.DecodeObject(&config, data); err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		tlsConfig, err := newAuthTLSConfig(config.TLS)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		clientSecret, err := resolveSecret("client_secret", config.ClientSecret)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		authenticator, err := authenticator.NewIntrospectionAuthenticator(authenticator.IntrospectionConfig{
+			Endpoint:          config.Endpoint,
+			ClientID:          config.ClientID,
+			ClientSecret:      clientSecret,
+			TLS:               tlsConfig,
+			RolesClaim:        config.RolesClaim,
+			RoleMappings:      config.RoleMappings,
+			DisableTokenCache: config.DisableTokenCache,
+		})
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
+		}
+		return authenticator, nil
+	case "MTLS":
+		// check if data is defined
+		if data == nil {
+			return nil, errors.New("MTLS Authenticator plugin ('config > plugins > Authenticator MTLS > plugin_data') not populated")
+		}
+		var config pluginAuthenticatorMTLS
+		if err := hcl.DecodeObject(&config, data); err != nil {
+			return nil, errors.Errorf("Couldn't parse Authenticator config: %v", err)
+		}
+		authenticator, err := authenticator.NewMTLSAuthenticator(newSPIFFEIDRoleMappings(config.RoleMappings))
 		if err != nil {
 			return nil, errors.Errorf("Couldn't configure Authenticator: %v", err)
 		}
@@ -197,6 +758,31 @@ func NewAuthorizer(authorizerPlugin *ast.ObjectItem) (authorization.Authorizer,
 			return nil, errors.Errorf("Couldn't configure Authorizer: %v", err)
 		}
 		return authorizer, nil
+	case "Rego":
+		// check if data is defined
+		if data == nil {
+			return nil, errors.New("Rego Authorizer plugin ('config > plugins > Authorizer Rego > plugin_data') not populated")
+		}
+		var config pluginAuthorizerRego
+		if err := hcl.DecodeObject(&config, data); err != nil {
+			return nil, errors.Errorf("Couldn't parse Authorizer config: %v", err)
+		}
+		if (config.Policy == "") == (config.PolicyFile == "") {
+			return nil, errors.New("Couldn't parse Authorizer config: exactly one of policy or policy_file is required")
+		}
+		policy := config.Policy
+		if config.PolicyFile != "" {
+			raw, err := os.ReadFile(config.PolicyFile)
+			if err != nil {
+				return nil, errors.Errorf("Couldn't read Authorizer policy_file: %v", err)
+			}
+			policy = string(raw)
+		}
+		authorizer, err := authorization.NewRegoAuthorizer(context.Background(), policy, config.Query)
+		if err != nil {
+			return nil, errors.Errorf("Couldn't configure Authorizer: %v", err)
+		}
+		return authorizer, nil
 	default:
 		return nil, errors.Errorf("Invalid option for Authorizer named %s", key)
 	}
@@ -224,7 +810,7 @@ func (s *Server) VerifyConfiguration() error {
 
 func (s *Server) ConfigureDefaults() error {
 	// no authorization is a default
-	s.Authenticator = authenticator.NewNullAuthenticator()
+	s.Authenticator = authenticator.NewNoopAuthenticator()
 	s.Authorizer = authorization.NewNullAuthorizer()
 	return nil
 }
@@ -256,6 +842,8 @@ func (s *Server) Configure() error {
 	}
 
 	// iterate over plugin list
+	// multiple Authenticator plugins are chained in the order given
+	authenticators := []authenticator.Authenticator{}
 
 	for _, pluginObject := range pluginList.Items {
 		pluginType, err := stringFromToken(pluginObject.Keys[0].Token)
@@ -289,10 +877,11 @@ func (s *Server) Configure() error {
 			if len(pluginObject.Keys) != 2 {
 				return fmt.Errorf("plugin Authenticator expected to have two keys (type then name)")
 			}
-			s.Authenticator, err = NewAuthenticator(pluginObject)
+			pluginAuthenticator, err := NewAuthenticator(pluginObject)
 			if err != nil {
 				return errors.Errorf("Cannot configure Authenticator plugin: %v", err)
 			}
+			authenticators = append(authenticators, pluginAuthenticator)
 		// configure Authorizer
 		case "Authorizer":
 			if len(pluginObject.Keys) != 2 {
@@ -306,5 +895,13 @@ func (s *Server) Configure() error {
 		// TODO Handle when multiple plugins configured
 	}
 
+	switch len(authenticators) {
+	case 0: // keep default
+	case 1:
+		s.Authenticator = authenticators[0]
+	default:
+		s.Authenticator = authenticator.NewChainAuthenticator(authenticators...)
+	}
+
 	return nil
 }
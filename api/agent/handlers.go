@@ -9,6 +9,8 @@ import (
 
 	trustdomain "github.com/spiffe/spire-api-sdk/proto/spire/api/server/trustdomain/v1"
 	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/authenticator"
 )
 
 func (s *Server) healthcheck(w http.ResponseWriter, r *http.Request) {
@@ -751,6 +753,15 @@ func (s *Server) home(w http.ResponseWriter, r *http.Request) {
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	var ret = "Endpoint is healthy."
 
+	// unhealthy if the authenticator cannot validate tokens
+	if checker, ok := s.Authenticator.(authenticator.HealthChecker); ok {
+		if err := checker.Healthy(); err != nil {
+			emsg := fmt.Sprintf("Authenticator is not healthy: %v", err.Error())
+			retError(w, emsg, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	cors(w, r)
 	je := json.NewEncoder(w)
 
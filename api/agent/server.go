@@ -16,6 +16,7 @@ import (
 	"github.com/hashicorp/hcl/hcl/ast"
 
 	"github.com/spiffe/tornjak/pkg/agent/authentication/authenticator"
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
 	"github.com/spiffe/tornjak/pkg/agent/authorization"
 	agentdb "github.com/spiffe/tornjak/pkg/agent/db"
 	"github.com/spiffe/tornjak/pkg/agent/spirecrd"
@@ -79,11 +80,29 @@ func (s *Server) verificationMiddleware(next http.Handler) http.Handler {
 		err := s.Authorizer.AuthorizeRequest(r, userInfo)
 		if err != nil {
 			emsg := fmt.Sprintf("Error authorizing request: %v", err.Error())
+			// authenticated users without access get 403, otherwise 401
+			status := authenticator.StatusCode(err)
+			if userInfo != nil && userInfo.AuthenticationError == nil {
+				status = http.StatusForbidden
+			}
+			if status == http.StatusUnauthorized {
+				var authErr error
+				if userInfo != nil {
+					authErr = userInfo.AuthenticationError
+				}
+				w.Header().Set("WWW-Authenticate", authenticator.Challenge(authErr))
+			}
 			// error should be written already
-			retError(w, emsg, http.StatusUnauthorized)
+			retError(w, emsg, status)
 			return
 		}
 
+		// make the authenticated user available to handlers
+		if userInfo != nil && userInfo.AuthenticationError == nil {
+			r = r.WithContext(user.ContextWithUserInfo(r.Context(), userInfo))
+			authenticator.SetTokenExpiresAtHeader(w, userInfo)
+		}
+
 		next.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(f)
@@ -181,6 +200,24 @@ func (s *Server) GetRouter() http.Handler {
 	// Healthcheck (never goes through authn/authz layers)
 	healthRtr.HandleFunc("", s.health)
 
+	// Authentication metrics (never go through authn/authz layers)
+	if exporter, ok := s.Authenticator.(authenticator.MetricsExporter); ok {
+		if handler := exporter.MetricsHandler(); handler != nil {
+			rtr.Handle("/metrics", handler).Methods(http.MethodGet)
+		}
+	}
+
+	// Browser login (never goes through authn/authz layers)
+	if handlers, ok := s.Authenticator.(authenticator.LoginHandlers); ok {
+		if login, callback := handlers.LoginHandlers(); login != nil {
+			rtr.HandleFunc("/login", login).Methods(http.MethodGet)
+			rtr.HandleFunc("/login/callback", callback).Methods(http.MethodGet)
+			// POST only, so that cross-site links and images cannot log
+			// users out, the token cookies being SameSite=Lax
+			rtr.HandleFunc("/logout", handlers.LogoutHandler()).Methods(http.MethodPost)
+		}
+	}
+
 	// Home
 	apiRtr.HandleFunc("/", s.home)
 
@@ -338,4 +375,20 @@ func (s *Server) HandleRequests() {
 		err := <-errChannel
 		log.Printf("%v", err)
 	}
+
+	err = s.Close()
+	if err != nil {
+		log.Printf("Error closing server: %v", err)
+	}
+}
+
+// Close releases resources held by the server plugins,
+// such as background goroutines of the Authenticator
+func (s *Server) Close() error {
+	if s.Authenticator != nil {
+		if err := s.Authenticator.Close(); err != nil {
+			return fmt.Errorf("failed closing Authenticator: %w", err)
+		}
+	}
+	return nil
 }
@@ -113,8 +113,208 @@ type pluginControllerManager struct {
 }
 
 type pluginAuthenticatorKeycloak struct {
-	IssuerURL string `hcl:"issuer"`
-	Audience  string `hcl:"audience"`
+	IssuerURL         string              `hcl:"issuer"`
+	ExpectedIssuer    string              `hcl:"expected_issuer"`
+	Audience          string              `hcl:"audience"`
+	Audiences         []string            `hcl:"audiences"`
+	AuthorizedParty   string              `hcl:"authorized_party"`
+	JWKS              *jwksConfig         `hcl:"jwks"`
+	RoleMappings      map[string]string   `hcl:"role_mappings"`
+	RoleMappingsFile  string              `hcl:"role_mappings_file"`
+	RolePrefix        string              `hcl:"role_prefix"`
+	CompositeRoles    map[string][]string `hcl:"composite_roles"`
+	ScopeMappings     map[string]string   `hcl:"scope_mappings"`
+	RolePatterns      []*rolePattern      `hcl:"role_pattern,block"`
+	RequireMappedRole bool                `hcl:"require_mapped_role"`
+	SingleUseRoles    []string            `hcl:"single_use_roles"`
+	RolesClaim        string              `hcl:"roles_claim"`
+	RolesClientID     string              `hcl:"roles_client_id"`
+	Leeway            string              `hcl:"leeway"`
+	MaxTokenAge       string              `hcl:"max_token_age"`
+	MinRemainingTTL   string              `hcl:"min_remaining_ttl"`
+	TokenCookie       string              `hcl:"token_cookie"`
+	TokenHeader       string              `hcl:"token_header"`
+	TokenSchemes      []string            `hcl:"token_schemes"`
+	Login             *keycloakLogin      `hcl:"login"`
+	DisableTokenCache bool                `hcl:"disable_token_cache"`
+	RoleCacheTTL      string              `hcl:"role_cache_ttl"`
+	UserInfoRoles     bool                `hcl:"userinfo_roles"`
+	UserInfoCacheTTL  string              `hcl:"userinfo_cache_ttl"`
+	DiscoveryRetry    *discoveryRetry     `hcl:"discovery_retry"`
+	DiscoveryRefresh  string              `hcl:"discovery_refresh_interval"`
+	TLS               *authTLSConfig      `hcl:"tls"`
+	AllowInsecure     bool                `hcl:"allow_insecure"`
+	HMACSecret        string              `hcl:"hmac_secret"`
+	JWKSFile          string              `hcl:"jwks_file"`
+	WatchJWKSFile     bool                `hcl:"watch_jwks_file"`
+	JWKSSecret        *jwksSecret         `hcl:"jwks_secret"`
+	JWKSURL           string              `hcl:"jwks_url"`
+	JWKSURLs          []string            `hcl:"jwks_urls"`
+	PublicKeys        []*publicKey        `hcl:"public_key,block"`
+	AllowedAlgorithms []string            `hcl:"allowed_algorithms"`
+	Realms            []*keycloakRealm    `hcl:"realm,block"`
+	TenantClaim       string              `hcl:"tenant_claim"`
+	Tenants           []*keycloakTenant   `hcl:"tenant,block"`
+
+	AllowedNetworks        []string `hcl:"allowed_networks"`
+	TrustedProxyHops       int      `hcl:"trusted_proxy_hops"`
+	NetworkRestrictedRoles []string `hcl:"network_restricted_roles"`
+
+	AuditLog string `hcl:"audit_log"`
+
+	TokenFormField      string   `hcl:"token_form_field"`
+	TokenQueryParameter string   `hcl:"token_query_parameter"`
+	TokenQueryPaths     []string `hcl:"token_query_paths"`
+
+	DiscoveryCacheFile   string `hcl:"discovery_cache_file"`
+	DiscoveryCacheMaxAge string `hcl:"discovery_cache_max_age"`
+
+	EnforceAudience *bool `hcl:"enforce_audience"`
+
+	GroupsClaim   string          `hcl:"groups_claim"`
+	GroupMappings []*groupMapping `hcl:"group_mapping,block"`
+
+	RequiredTokenType string `hcl:"required_token_type"`
+
+	Transport *authTransportConfig `hcl:"transport"`
+
+	DecryptionKeyFile string `hcl:"decryption_key_file"`
+	RequireEncryption bool   `hcl:"require_encryption"`
+
+	RequireEmailVerified bool `hcl:"require_email_verified"`
+
+	AllowedKIDs []string `hcl:"allowed_kids"`
+
+	HostAudiences map[string]string `hcl:"host_audiences"`
+
+	Metrics bool `hcl:"metrics"`
+}
+
+// rolePattern maps token roles matching a glob pattern to a Tornjak role,
+// keyed by the pattern
+type rolePattern struct {
+	Pattern string `hcl:",key"`
+	Role    string `hcl:"role"`
+}
+
+// groupMapping maps the members of a group to a Tornjak role, keyed by the
+// group path, or the group name when matching the leaf
+type groupMapping struct {
+	Group string `hcl:",key"`
+	Match string `hcl:"match"`
+	Role  string `hcl:"role"`
+}
+
+// publicKey is a PEM encoded public key verifying tokens, keyed by the kid
+// it matches; an empty kid matches any token
+type publicKey struct {
+	KID     string `hcl:",key"`
+	PEM     string `hcl:"pem"`
+	PEMFile string `hcl:"pem_file"`
+}
+
+// keycloakTenant holds the role mappings of a tenant served by the
+// Keycloak plugin, keyed by its name
+type keycloakTenant struct {
+	Name         string            `hcl:",key"`
+	RoleMappings map[string]string `hcl:"role_mappings"`
+}
+
+// keycloakRealm is an additional issuer accepted by the Keycloak plugin,
+// keyed by its issuer URL
+type keycloakRealm struct {
+	IssuerURL      string   `hcl:",key"`
+	ExpectedIssuer string   `hcl:"expected_issuer"`
+	Audience       string   `hcl:"audience"`
+	Audiences      []string `hcl:"audiences"`
+}
+
+// keycloakLogin configures the browser login flow served at /login
+type keycloakLogin struct {
+	ClientID      string   `hcl:"client_id"`
+	ClientSecret  string   `hcl:"client_secret"`
+	RedirectURL   string   `hcl:"redirect_url"`
+	Scopes        []string `hcl:"scopes"`
+	PostLoginURL  string   `hcl:"post_login_url"`
+	PostLogoutURL string   `hcl:"post_logout_url"`
+}
+
+// authTLSConfig configures TLS towards the issuer; min_version is one of
+// "1.0", "1.1", "1.2" or "1.3"
+type authTLSConfig struct {
+	CAFile     string `hcl:"ca_file"`
+	CAPEM      string `hcl:"ca_pem"`
+	MinVersion string `hcl:"min_version"`
+}
+
+// authTransportConfig tunes the connections to the issuer
+type authTransportConfig struct {
+	MaxIdleConns        int    `hcl:"max_idle_conns"`
+	MaxIdleConnsPerHost int    `hcl:"max_idle_conns_per_host"`
+	IdleConnTimeout     string `hcl:"idle_conn_timeout"`
+	ForceHTTP2          bool   `hcl:"force_http2"`
+}
+
+type discoveryRetry struct {
+	MaxAttempts    int    `hcl:"max_attempts"`
+	MaxElapsedTime string `hcl:"max_elapsed_time"`
+}
+
+// durations are given as strings parsed by time.ParseDuration, e.g. "1h"
+type jwksConfig struct {
+	RefreshInterval      string  `hcl:"refresh_interval"`
+	RefreshRateLimit     string  `hcl:"refresh_rate_limit"`
+	RefreshTimeout       string  `hcl:"refresh_timeout"`
+	RefreshUnknownKID    *bool   `hcl:"refresh_unknown_kid"`
+	UnhealthyAfter       string  `hcl:"unhealthy_after"`
+	DisableRefresh       bool    `hcl:"disable_refresh"`
+	RespectCacheHeaders  bool    `hcl:"respect_cache_headers"`
+	RetryInitialInterval string  `hcl:"retry_initial_interval"`
+	RetryMaxInterval     string  `hcl:"retry_max_interval"`
+	RetryJitter          float64 `hcl:"retry_jitter"`
+
+	AllowEmpty bool `hcl:"allow_empty"`
+}
+
+// jwksSecret names the Kubernetes Secret holding the JWKS, read with the
+// in-cluster client
+type jwksSecret struct {
+	Namespace string `hcl:"namespace"`
+	Name      string `hcl:"name"`
+	Key       string `hcl:"key"`
+	Watch     bool   `hcl:"watch"`
+}
+
+type pluginAuthenticatorNull struct {
+	Roles []string `hcl:"roles"`
+}
+
+type pluginAuthenticatorJWTSVID struct {
+	TrustDomain  string           `hcl:"trust_domain"`
+	BundleFile   string           `hcl:"bundle_file"`
+	Audience     string           `hcl:"audience"`
+	Audiences    []string         `hcl:"audiences"`
+	RoleMappings []*spiffeIDRoles `hcl:"spiffe_id,block"`
+}
+
+type pluginAuthenticatorIntrospection struct {
+	Endpoint          string            `hcl:"endpoint"`
+	ClientID          string            `hcl:"client_id"`
+	ClientSecret      string            `hcl:"client_secret"`
+	TLS               *authTLSConfig    `hcl:"tls"`
+	RolesClaim        string            `hcl:"roles_claim"`
+	RoleMappings      map[string]string `hcl:"role_mappings"`
+	DisableTokenCache bool              `hcl:"disable_token_cache"`
+}
+
+type pluginAuthenticatorMTLS struct {
+	RoleMappings []*spiffeIDRoles `hcl:"spiffe_id,block"`
+}
+
+// spiffeIDRoles grants roles to SPIFFE IDs, keyed by a SPIFFE ID pattern
+type spiffeIDRoles struct {
+	Pattern string   `hcl:",key"`
+	Roles   []string `hcl:"roles"`
 }
 
 type AuthRole struct {
@@ -134,3 +334,10 @@ type pluginAuthorizerRBAC struct {
 	RoleList        []*AuthRole       `hcl:"role,block"`
 	APIv1RoleMappings []*APIv1RoleMapping `hcl:"APIv1,block"`
 }
+
+// pluginAuthorizerRego holds a Rego policy, inline or read from a file
+type pluginAuthorizerRego struct {
+	Policy     string `hcl:"policy"`
+	PolicyFile string `hcl:"policy_file"`
+	Query      string `hcl:"query"`
+}
@@ -0,0 +1,138 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// AuditDecision is the outcome of an authentication
+type AuditDecision string
+
+const (
+	AuditAllow AuditDecision = "allow"
+	AuditDeny  AuditDecision = "deny"
+)
+
+// AuthEvent records an authentication decision for the audit log. It never
+// carries the token.
+type AuthEvent struct {
+	Time     time.Time     `json:"time"`
+	Decision AuditDecision `json:"decision"`
+	// Reason classifies denials like the failures metric, e.g. "expired";
+	// empty when allowed
+	Reason string `json:"reason,omitempty"`
+	// Subject and Roles are those of the authenticated user, empty when
+	// denied, as the claims of a rejected token cannot be trusted
+	Subject string   `json:"subject,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	Tenant  string   `json:"tenant,omitempty"`
+	// request metadata, empty for tokens authenticated without a request
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Path       string `json:"path,omitempty"`
+}
+
+// AuditSink receives an AuthEvent for every authentication decision. It is
+// called synchronously on the request path and must be safe for concurrent
+// use. A sink that is also an io.Closer is owned by the authenticator it
+// is configured for: it is closed by Close, but not if the construction of
+// the authenticator fails.
+type AuditSink interface {
+	Record(event AuthEvent)
+}
+
+// sharedAuditSink records with the AuditSink of another authenticator,
+// which owns it, and so is not an io.Closer
+type sharedAuditSink struct {
+	AuditSink
+}
+
+// jsonAuditSink writes each event as a line of JSON
+type jsonAuditSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	// closer is the file written to, nil if the sink does not own w
+	closer io.Closer
+}
+
+// NewJSONAuditSink returns an AuditSink writing each event to w as a single
+// line of JSON. w is not closed with the sink.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{encoder: json.NewEncoder(w)}
+}
+
+// OpenJSONAuditLog returns an AuditSink appending each event as a single
+// line of JSON to the file at path, created with mode 0600 if missing. The
+// file is closed with the sink.
+func OpenJSONAuditLog(path string) (AuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Errorf("Could not open audit log %s: %v", path, err)
+	}
+	return &jsonAuditSink{encoder: json.NewEncoder(file), closer: file}, nil
+}
+
+// Close closes the file of a sink returned by OpenJSONAuditLog
+func (s *jsonAuditSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closer.Close()
+}
+
+// closeAuditSink closes sink if it is an io.Closer
+func closeAuditSink(sink AuditSink) error {
+	if closer, ok := sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *jsonAuditSink) Record(event AuthEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a failed write cannot be reported to the request, the event is lost
+	_ = s.encoder.Encode(event)
+}
+
+// audit records the decision on userInfo, authenticated from r if not nil,
+// with the audit sink if one is configured
+func (a *KeycloakAuthenticator) audit(userInfo *user.UserInfo, r *http.Request) {
+	recordAuthEvent(a.auditSink, a.now(), userInfo, r)
+}
+
+// recordAuthEvent records the decision on userInfo, taken at t from r if
+// not nil, with sink unless it is nil
+func recordAuthEvent(sink AuditSink, t time.Time, userInfo *user.UserInfo, r *http.Request) {
+	if sink == nil {
+		return
+	}
+	event := AuthEvent{
+		Time:     t,
+		Decision: AuditAllow,
+	}
+	if err := userInfo.AuthenticationError; err != nil {
+		event.Decision = AuditDeny
+		event.Reason = failureReason(err)
+	} else {
+		event.Subject = userInfo.Subject
+		event.Roles = append([]string{}, userInfo.Roles...)
+		event.Tenant = userInfo.Tenant
+	}
+	if r != nil {
+		event.RemoteAddr = r.RemoteAddr
+		event.Method = r.Method
+		event.Path = r.URL.Path
+	}
+	sink.Record(event)
+}
@@ -1,6 +1,7 @@
 package authenticator
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
@@ -11,4 +12,46 @@ type Authenticator interface {
 	// and returns relevant UserInfo to be interpreted by the Authorizer
 	// or error upon verification error
 	AuthenticateRequest(r *http.Request) *user.UserInfo
+
+	// Close releases resources held by the Authenticator,
+	// such as background goroutines
+	Close() error
+}
+
+// ContextAuthenticator is implemented by authenticators whose validation
+// may call out to the network, e.g. to the userinfo or introspection
+// endpoint, so that it can be cancelled or bounded by a deadline
+type ContextAuthenticator interface {
+	// AuthenticateRequestContext authenticates r like AuthenticateRequest,
+	// with outbound calls bound to ctx instead of r.Context(). The returned
+	// error is the AuthenticationError of the UserInfo.
+	AuthenticateRequestContext(ctx context.Context, r *http.Request) (*user.UserInfo, error)
+}
+
+// authenticateRequestContext authenticates r with a, bound to ctx if a is
+// a ContextAuthenticator
+func authenticateRequestContext(ctx context.Context, a Authenticator, r *http.Request) *user.UserInfo {
+	if contextAuthenticator, ok := a.(ContextAuthenticator); ok {
+		userInfo, _ := contextAuthenticator.AuthenticateRequestContext(ctx, r)
+		return userInfo
+	}
+	return a.AuthenticateRequest(r)
 }
+
+var (
+	_ ContextAuthenticator = (*KeycloakAuthenticator)(nil)
+	_ ContextAuthenticator = (*ChainAuthenticator)(nil)
+	_ ContextAuthenticator = (*MultiIssuerAuthenticator)(nil)
+	_ ContextAuthenticator = (*IntrospectionAuthenticator)(nil)
+)
+
+var (
+	_ Authenticator = (*KeycloakAuthenticator)(nil)
+	_ Authenticator = (*NullAuthenticator)(nil)
+	_ Authenticator = (*NoopAuthenticator)(nil)
+	_ Authenticator = (*ChainAuthenticator)(nil)
+	_ Authenticator = (*MultiIssuerAuthenticator)(nil)
+	_ Authenticator = (*JWTSVIDAuthenticator)(nil)
+	_ Authenticator = (*MTLSAuthenticator)(nil)
+	_ Authenticator = (*IntrospectionAuthenticator)(nil)
+)
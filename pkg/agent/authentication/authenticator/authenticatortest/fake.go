@@ -0,0 +1,156 @@
+// Package authenticatortest provides a scriptable Authenticator for tests of
+// code built on Tornjak's authentication, such as handlers behind the
+// authentication middleware. It is a testing utility and must not be used
+// in production: it authenticates whatever it is told to.
+package authenticatortest
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/authenticator"
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// FakeAuthenticator returns scripted UserInfos, one per call to
+// AuthenticateRequest in the order they were added, then the default one.
+// The zero value is ready to use and fails every request with
+// authenticator.ErrNoToken. It is safe for concurrent use.
+type FakeAuthenticator struct {
+	mu       sync.Mutex
+	script   []*user.UserInfo
+	fallback *user.UserInfo
+	requests []*http.Request
+	closed   bool
+}
+
+var _ authenticator.Authenticator = (*FakeAuthenticator)(nil)
+
+// NewFakeAuthenticator returns a FakeAuthenticator authenticating every
+// request, once the script is exhausted, as a user with the given roles
+func NewFakeAuthenticator(roles ...string) *FakeAuthenticator {
+	return &FakeAuthenticator{fallback: &user.UserInfo{Roles: roles}}
+}
+
+// SetDefault sets the UserInfo returned once the script is exhausted
+func (a *FakeAuthenticator) SetDefault(userInfo *user.UserInfo) *FakeAuthenticator {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fallback = userInfo
+	return a
+}
+
+// Return adds userInfo to the script
+func (a *FakeAuthenticator) Return(userInfo *user.UserInfo) *FakeAuthenticator {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.script = append(a.script, userInfo)
+	return a
+}
+
+// ReturnRoles adds a user authenticated with roles to the script
+func (a *FakeAuthenticator) ReturnRoles(roles ...string) *FakeAuthenticator {
+	return a.Return(&user.UserInfo{Roles: roles})
+}
+
+// ReturnError adds a failed authentication to the script
+func (a *FakeAuthenticator) ReturnError(err error) *FakeAuthenticator {
+	return a.Return(&user.UserInfo{AuthenticationError: err})
+}
+
+// ReturnNoToken adds a request without token to the script
+func (a *FakeAuthenticator) ReturnNoToken() *FakeAuthenticator {
+	return a.ReturnError(NoTokenError())
+}
+
+// ReturnExpired adds a request with an expired token to the script
+func (a *FakeAuthenticator) ReturnExpired() *FakeAuthenticator {
+	return a.ReturnError(ExpiredTokenError())
+}
+
+// ReturnInsufficientRoles adds a request whose token lacks the required
+// roles to the script
+func (a *FakeAuthenticator) ReturnInsufficientRoles(required ...string) *FakeAuthenticator {
+	return a.ReturnError(InsufficientRolesError(required...))
+}
+
+func (a *FakeAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests = append(a.requests, r)
+	if len(a.script) > 0 {
+		userInfo := a.script[0]
+		a.script = a.script[1:]
+		return copyUserInfo(userInfo)
+	}
+	if a.fallback == nil {
+		return &user.UserInfo{AuthenticationError: NoTokenError()}
+	}
+	return copyUserInfo(a.fallback)
+}
+
+// copyUserInfo copies u, so that callers modifying the UserInfos returned
+// do not change the script, the default or later results
+func copyUserInfo(u *user.UserInfo) *user.UserInfo {
+	if u == nil {
+		return nil
+	}
+	userInfo := *u
+	userInfo.Roles = append([]string(nil), u.Roles...)
+	if u.Attributes != nil {
+		userInfo.Attributes = make(map[string]string, len(u.Attributes))
+		for name, value := range u.Attributes {
+			userInfo.Attributes[name] = value
+		}
+	}
+	if u.Claims != nil {
+		userInfo.Claims = make(map[string]interface{}, len(u.Claims))
+		for name, value := range u.Claims {
+			userInfo.Claims[name] = value
+		}
+	}
+	return &userInfo
+}
+
+func (a *FakeAuthenticator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	return nil
+}
+
+// Requests returns the requests authenticated so far, in order
+func (a *FakeAuthenticator) Requests() []*http.Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*http.Request(nil), a.requests...)
+}
+
+// Closed reports whether Close was called
+func (a *FakeAuthenticator) Closed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
+
+// NoTokenError returns an error matching authenticator.ErrNoToken
+func NoTokenError() error {
+	return fmt.Errorf("Authorization header missing: %w", authenticator.ErrNoToken)
+}
+
+// InvalidTokenError returns an error matching authenticator.ErrInvalidToken
+func InvalidTokenError() error {
+	return fmt.Errorf("Token is invalid: %w", authenticator.ErrInvalidToken)
+}
+
+// ExpiredTokenError returns an error matching authenticator.ErrTokenExpired
+func ExpiredTokenError() error {
+	return fmt.Errorf("Token expired, please re-authenticate: %w", authenticator.ErrTokenExpired)
+}
+
+// InsufficientRolesError returns an error matching
+// authenticator.ErrInsufficientRoles
+func InsufficientRolesError(required ...string) error {
+	return fmt.Errorf("Token lacks required roles %v: %w", required, authenticator.ErrInsufficientRoles)
+}
@@ -0,0 +1,113 @@
+package authenticator
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// maximum number of tokens kept in the token cache
+const tokenCacheMaxEntries = 10000
+
+type tokenCacheEntry struct {
+	userInfo *user.UserInfo
+	expiry   time.Time
+}
+
+// tokenCache keeps the UserInfo of validated tokens until the tokens expire.
+// Tokens are keyed by their hash so raw tokens are not kept in memory.
+// It is safe for concurrent use.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]tokenCacheEntry
+	now     func() time.Time // clock the expiries are checked against
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		entries: make(map[[sha256.Size]byte]tokenCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// copyUserInfo returns a copy of u so cached values cannot be modified by callers
+func copyUserInfo(u *user.UserInfo) *user.UserInfo {
+	userInfo := *u
+	userInfo.Roles = append([]string(nil), u.Roles...)
+	if u.Attributes != nil {
+		userInfo.Attributes = make(map[string]string, len(u.Attributes))
+		for name, value := range u.Attributes {
+			userInfo.Attributes[name] = value
+		}
+	}
+	if u.Claims != nil {
+		userInfo.Claims = copyClaimValue(u.Claims).(map[string]interface{})
+	}
+	return &userInfo
+}
+
+// get returns the cached UserInfo of a token that has not yet expired
+func (c *tokenCache) get(token string) (*user.UserInfo, bool) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiry) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return copyUserInfo(entry.userInfo), true
+}
+
+// put caches the UserInfo of a token until its expiry
+func (c *tokenCache) put(token string, userInfo *user.UserInfo, expiry time.Time) {
+	now := c.now()
+	if !now.Before(expiry) {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= tokenCacheMaxEntries {
+		c.removeExpired(now)
+		if len(c.entries) >= tokenCacheMaxEntries { // still full, skip caching
+			return
+		}
+	}
+	c.entries[key] = tokenCacheEntry{
+		userInfo: copyUserInfo(userInfo),
+		expiry:   expiry,
+	}
+}
+
+// remove drops the entry of a token
+func (c *tokenCache) remove(token string) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// clear drops all entries
+func (c *tokenCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[[sha256.Size]byte]tokenCacheEntry)
+}
+
+// removeExpired drops expired entries, must be called with c.mu held
+func (c *tokenCache) removeExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiry) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package authenticator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// ChainAuthenticator tries several authenticators in order and returns the
+// first successful UserInfo. This allows running two authentication schemes
+// side by side, for example during a migration.
+type ChainAuthenticator struct {
+	authenticators []Authenticator
+}
+
+func NewChainAuthenticator(authenticators ...Authenticator) *ChainAuthenticator {
+	return &ChainAuthenticator{
+		authenticators: authenticators,
+	}
+}
+
+// chainError aggregates the errors of every authenticator in a chain
+type chainError struct {
+	errs []error
+}
+
+func (e *chainError) Error() string {
+	return fmt.Sprintf("All authenticators failed: %s", joinChainErrors(e.errs))
+}
+
+func (e *chainError) Unwrap() []error {
+	return e.errs
+}
+
+// chainCloseError aggregates the errors of the authenticators in a chain
+// that failed to close
+type chainCloseError struct {
+	errs []error
+}
+
+func (e *chainCloseError) Error() string {
+	return fmt.Sprintf("Closing authenticators failed: %s", joinChainErrors(e.errs))
+}
+
+func (e *chainCloseError) Unwrap() []error {
+	return e.errs
+}
+
+// joinChainErrors numbers errs and joins them into one message
+func joinChainErrors(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = fmt.Sprintf("[%d] %v", i+1, err)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (a *ChainAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	userInfo, _ := a.AuthenticateRequestContext(r.Context(), r)
+	return userInfo
+}
+
+// AuthenticateRequestContext tries the authenticators like
+// AuthenticateRequest, passing ctx to those that are ContextAuthenticators
+func (a *ChainAuthenticator) AuthenticateRequestContext(ctx context.Context, r *http.Request) (*user.UserInfo, error) {
+	errs := []error{}
+	for _, authenticator := range a.authenticators {
+		userInfo := authenticateRequestContext(ctx, authenticator, r)
+		if userInfo == nil { // authenticator passes no user information
+			continue
+		}
+		if userInfo.AuthenticationError == nil {
+			return userInfo, nil
+		}
+		errs = append(errs, userInfo.AuthenticationError)
+	}
+	if len(errs) == 0 {
+		err := newAuthError(ErrNoToken, nil, "No authenticator could authenticate the request")
+		return wrapAuthenticationError(err), err
+	}
+	err := &chainError{errs: errs}
+	return wrapAuthenticationError(err), err
+}
+
+// Close closes every authenticator in the chain
+func (a *ChainAuthenticator) Close() error {
+	errs := []error{}
+	for _, authenticator := range a.authenticators {
+		if err := authenticator.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return &chainCloseError{errs: errs}
+	}
+	return nil
+}
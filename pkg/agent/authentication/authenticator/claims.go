@@ -0,0 +1,101 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// UnmarshalJSON decodes the known claims and also keeps the full claim set
+// so that configurable claim paths can be resolved. email_verified is true
+// only if it is true or "true", as some issuers send it as a string.
+func (c *KeycloakClaim) UnmarshalJSON(data []byte) error {
+	type keycloakClaim KeycloakClaim
+	claim := struct {
+		*keycloakClaim
+		EmailVerified interface{} `json:"email_verified"`
+	}{keycloakClaim: (*keycloakClaim)(c)}
+	if err := json.Unmarshal(data, &claim); err != nil {
+		return err
+	}
+	c.EmailVerified = claim.EmailVerified == true || claim.EmailVerified == "true"
+	return json.Unmarshal(data, &c.raw)
+}
+
+// StringsAt walks the claims along a dot separated path such as
+// "realm_access.roles" and returns the string values found there.
+// A missing claim or a claim that is not a string or list of strings
+// returns nil.
+func (c *KeycloakClaim) StringsAt(path string) []string {
+	var value interface{} = c.raw
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return stringValues(value)
+}
+
+// Claims returns a copy of the full claim set, as decoded from JSON
+func (c *KeycloakClaim) Claims() map[string]interface{} {
+	if c.raw == nil {
+		return map[string]interface{}{}
+	}
+	return copyClaimValue(c.raw).(map[string]interface{})
+}
+
+// copyClaimValue deep copies a value decoded from JSON, so that handlers
+// modifying claims do not alter those of cached tokens
+func copyClaimValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			copied[key] = copyClaimValue(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = copyClaimValue(v)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// UnmarshalJSON decodes the roles of an access claim such as realm_access,
+// leaving them empty if the claim is null or not shaped as expected, rather
+// than failing the whole token
+func (c *RealmAccessSubclaim) UnmarshalJSON(data []byte) error {
+	var claim interface{}
+	if err := json.Unmarshal(data, &claim); err != nil {
+		return err
+	}
+	c.Roles = nil
+	if object, ok := claim.(map[string]interface{}); ok {
+		c.Roles = stringValues(object["roles"])
+	}
+	return nil
+}
+
+// stringValues returns value if it is a string, or its strings if it is a
+// list, nil otherwise
+func stringValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, elem := range v {
+			if str, ok := elem.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/pardot/oidc/discovery"
+	"github.com/pkg/errors"
+)
+
+// path of the OIDC discovery document relative to the issuer
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// providerMetadata adds the end_session_endpoint of OpenID Connect
+// RP-Initiated Logout to the provider metadata
+type providerMetadata struct {
+	discovery.ProviderMetadata
+	EndSessionEndpoint string `json:"end_session_endpoint,omitempty"`
+}
+
+// discoverMetadata fetches the OIDC provider metadata of the issuer with
+// client, or http.DefaultClient if nil. The request is bound to ctx so a
+// slow or unreachable issuer can be cancelled.
+func discoverMetadata(ctx context.Context, client *http.Client, issuerURL string) (*providerMetadata, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	discoveryURL := strings.TrimSuffix(issuerURL, "/") + oidcDiscoveryPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, errors.Errorf("Could not create request for %s: %v", discoveryURL, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("Error fetching %s: %v", discoveryURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error fetching %s: unexpected status %s", discoveryURL, resp.Status)
+	}
+
+	metadata := &providerMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, errors.Errorf("Error decoding provider metadata from %s: %v", discoveryURL, err)
+	}
+	return metadata, nil
+}
+
+// DiscoveryRetryConfig configures retries of OIDC discovery at startup,
+// for example while the issuer is not up yet. Retries are disabled when
+// both fields are zero.
+type DiscoveryRetryConfig struct {
+	// MaxAttempts is the maximum number of discovery attempts, zero for no limit
+	MaxAttempts int
+	// MaxElapsedTime bounds the total time spent retrying, zero for no limit
+	MaxElapsedTime time.Duration
+}
+
+func (c DiscoveryRetryConfig) enabled() bool {
+	return c.MaxAttempts > 0 || c.MaxElapsedTime > 0
+}
+
+// discoverMetadataWithRetry performs OIDC discovery of the issuer with
+// discover, retrying with exponential backoff as configured until ctx is done
+func discoverMetadataWithRetry(ctx context.Context, discover func(context.Context) (*providerMetadata, error), issuerURL string, retryConfig DiscoveryRetryConfig, logger Logger) (*providerMetadata, error) {
+	if !retryConfig.enabled() {
+		return discover(ctx)
+	}
+
+	expBackoff := backoff.NewExponentialBackOff()
+	expBackoff.MaxElapsedTime = retryConfig.MaxElapsedTime
+	var retryBackoff backoff.BackOff = expBackoff
+	if retryConfig.MaxAttempts > 0 {
+		retryBackoff = backoff.WithMaxRetries(retryBackoff, uint64(retryConfig.MaxAttempts-1))
+	}
+
+	var metadata *providerMetadata
+	operation := func() error {
+		var err error
+		metadata, err = discover(ctx)
+		return err
+	}
+	notify := func(err error, wait time.Duration) {
+		logger.Warnf("OIDC discovery with issuer = '%s' failed, retrying in %v: %v", issuerURL, wait, err)
+	}
+	err := backoff.RetryNotify(operation, backoff.WithContext(retryBackoff, ctx), notify)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// startRediscovery repeats OIDC discovery every interval until Close. When
+// the JWKS URI changed, the keys are replaced by ones from newKeySource.
+// Failures are logged and the last known good keys are kept.
+func (a *KeycloakAuthenticator) startRediscovery(interval time.Duration, discover func(context.Context) (*providerMetadata, error), newKeySource func(*providerMetadata) (*keySource, error)) {
+	a.runInBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			metadata, err := discover(ctx)
+			if ctx.Err() != nil { // closed during discovery
+				return
+			}
+			if err != nil {
+				a.logger.Errorf("OIDC rediscovery failed, keeping last known JWKS: %v", err)
+				continue
+			}
+			current := a.keys.Load()
+			if metadata.JWKSURI == current.jwksURL {
+				continue
+			}
+			keys, err := newKeySource(metadata)
+			if err != nil {
+				a.logger.Errorf("Could not load JWKS from new URI %s, keeping last known JWKS: %v", metadata.JWKSURI, err)
+				continue
+			}
+			a.keys.Store(keys)
+			current.jwks.EndBackground()
+			a.logger.Warnf("JWKS URI changed from %s to %s", current.jwksURL, metadata.JWKSURI)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+)
+
+// oldest cached provider metadata used when none is configured
+const defaultDiscoveryCacheMaxAge = 24 * time.Hour
+
+// longest wait between background discovery attempts while running on
+// cached provider metadata
+const maxDiscoveryRetryInterval = time.Minute
+
+// discoveryCacheMu serializes updates of discovery cache files, which the
+// authenticators of several issuers may share
+var discoveryCacheMu sync.Mutex
+
+// cachedMetadata is the provider metadata of an issuer saved to the
+// discovery cache file, keyed by issuer URL
+type cachedMetadata struct {
+	SavedAt  time.Time         `json:"saved_at"`
+	Metadata *providerMetadata `json:"metadata"`
+}
+
+// discoveryCacheMaxAge returns the maximum age of cached provider metadata
+func (c KeycloakConfig) discoveryCacheMaxAge() time.Duration {
+	if c.DiscoveryCacheMaxAge == 0 {
+		return defaultDiscoveryCacheMaxAge
+	}
+	return c.DiscoveryCacheMaxAge
+}
+
+// readDiscoveryCache returns the entries of the discovery cache file at
+// path, none if it does not exist
+func readDiscoveryCache(path string) (map[string]cachedMetadata, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]cachedMetadata{}, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("Could not read discovery cache file %s: %v", path, err)
+	}
+	entries := map[string]cachedMetadata{}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, errors.Errorf("Could not parse discovery cache file %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// loadCachedMetadata returns the provider metadata of issuerURL saved to
+// the discovery cache file at path, unless it is older than maxAge
+func loadCachedMetadata(path string, issuerURL string, maxAge time.Duration) (*providerMetadata, error) {
+	discoveryCacheMu.Lock()
+	entries, err := readDiscoveryCache(path)
+	discoveryCacheMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := entries[issuerURL]
+	if !ok || entry.Metadata == nil {
+		return nil, errors.Errorf("Discovery cache file %s holds no metadata of issuer '%s'", path, issuerURL)
+	}
+	if age := time.Since(entry.SavedAt); age > maxAge {
+		return nil, errors.Errorf("Metadata of issuer '%s' cached in %s is %v old, more than the maximum of %v", issuerURL, path, age.Round(time.Second), maxAge)
+	}
+	return entry.Metadata, nil
+}
+
+// saveCachedMetadata saves the provider metadata of issuerURL to the
+// discovery cache file at path. The file is replaced by a rename, so that
+// a crash never leaves it half written.
+func saveCachedMetadata(path string, issuerURL string, metadata *providerMetadata) error {
+	discoveryCacheMu.Lock()
+	defer discoveryCacheMu.Unlock()
+	entries, err := readDiscoveryCache(path)
+	if err != nil {
+		// an unreadable cache is replaced
+		entries = map[string]cachedMetadata{}
+	}
+	entries[issuerURL] = cachedMetadata{SavedAt: time.Now(), Metadata: metadata}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Errorf("Could not encode discovery cache: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Errorf("Could not write discovery cache file %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return errors.Errorf("Could not write discovery cache file %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Errorf("Could not write discovery cache file %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Errorf("Could not write discovery cache file %s: %v", path, err)
+	}
+	return nil
+}
+
+// retryDiscovery repeats OIDC discovery, with backoff, until it succeeds
+// or Close, for authenticators started on cached provider metadata. The
+// discovered metadata replaces the cached one, along with the keys if the
+// JWKS URI changed; otherwise the JWKS, which may have failed to load at
+// startup, is refreshed right away.
+func (a *KeycloakAuthenticator) retryDiscovery(discover func(context.Context) (*providerMetadata, error), newKeySource func(*providerMetadata) (*keySource, error)) {
+	a.runInBackground(func(ctx context.Context) {
+		retryBackOff := backoff.NewExponentialBackOff()
+		retryBackOff.MaxInterval = maxDiscoveryRetryInterval
+		retryBackOff.MaxElapsedTime = 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryBackOff.NextBackOff()):
+			}
+
+			metadata, err := discover(ctx)
+			if ctx.Err() != nil { // closed during discovery
+				return
+			}
+			if err != nil {
+				a.logger.Warnf("OIDC discovery failed, still using cached provider metadata: %v", err)
+				continue
+			}
+			current := a.keys.Load()
+			if metadata.JWKSURI != current.jwksURL {
+				keys, err := newKeySource(metadata)
+				if err != nil {
+					a.logger.Errorf("Could not load JWKS from new URI %s, still using cached provider metadata: %v", metadata.JWKSURI, err)
+					continue
+				}
+				a.keys.Store(keys)
+				current.jwks.EndBackground()
+				a.logger.Warnf("JWKS URI changed from %s to %s", current.jwksURL, metadata.JWKSURI)
+				return
+			}
+			a.keys.Store(&keySource{
+				metadata: metadata,
+				jwks:     current.jwks,
+				jwksURL:  current.jwksURL,
+				keyFunc:  current.keyFunc,
+			})
+			if err := a.RefreshJWKS(ctx); err != nil {
+				a.logger.Warnf("OIDC discovery succeeded, but the JWKS is still unavailable: %v", err)
+			}
+			return
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package authenticator
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of authentication errors, to be matched with errors.Is
+var (
+	// ErrNoToken signifies the request did not carry a token
+	ErrNoToken = errors.New("no token")
+	// ErrInvalidToken signifies the token is malformed or failed validation
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired signifies an otherwise valid token that expired; the
+	// client should re-authenticate to obtain a new one
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenExpiresSoon signifies a valid token expiring within the
+	// configured minimum remaining lifetime; the client should refresh it
+	ErrTokenExpiresSoon = errors.New("token expires soon")
+	// ErrInsufficientRoles signifies a valid token without the required roles
+	ErrInsufficientRoles = errors.New("insufficient roles")
+	// ErrUntrustedNetwork signifies a valid token presented from outside
+	// the allowed networks
+	ErrUntrustedNetwork = errors.New("untrusted network")
+	// ErrEmailNotVerified signifies a valid token whose email address is
+	// not verified, while a verified one is required
+	ErrEmailNotVerified = errors.New("email not verified")
+)
+
+// ErrWrongTokenType is the cause of errors, of kind ErrInvalidToken,
+// rejecting a token whose typ header is not the required token type, e.g.
+// an ID token sent where an access token is expected
+var ErrWrongTokenType = errors.New("wrong token type")
+
+// authError is an authentication error of a given kind. It keeps a
+// descriptive message and matches both its kind and its cause with errors.Is
+type authError struct {
+	kind  error
+	cause error
+	msg   string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+func (e *authError) Unwrap() []error {
+	if e.cause == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.cause}
+}
+
+func newAuthError(kind error, cause error, format string, args ...interface{}) error {
+	return &authError{
+		kind:  kind,
+		cause: cause,
+		msg:   fmt.Sprintf(format, args...),
+	}
+}
+
+// StatusCode returns the HTTP status code matching an authentication error:
+// 403 when the user lacks roles or a verified email address, or the request
+// comes from an untrusted network, 401 otherwise
+func StatusCode(err error) int {
+	if errors.Is(err, ErrInsufficientRoles) || errors.Is(err, ErrUntrustedNetwork) || errors.Is(err, ErrEmailNotVerified) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// Challenge returns the WWW-Authenticate header value matching an
+// authentication error, as defined by RFC 6750: a bare Bearer challenge
+// when no token was given, otherwise one naming the error. Descriptions
+// are fixed so that no token details are disclosed.
+func Challenge(err error) string {
+	switch {
+	case err == nil || errors.Is(err, ErrNoToken) && !errors.Is(err, ErrInvalidToken):
+		return "Bearer"
+	case errors.Is(err, ErrInsufficientRoles):
+		return `Bearer error="insufficient_scope", error_description="The access token lacks the required roles"`
+	case errors.Is(err, ErrUntrustedNetwork):
+		return `Bearer error="insufficient_scope", error_description="The access token may not be used from this network"`
+	case errors.Is(err, ErrEmailNotVerified):
+		return `Bearer error="insufficient_scope", error_description="The email address of the user is not verified"`
+	case errors.Is(err, ErrTokenExpired):
+		return `Bearer error="invalid_token", error_description="The access token expired"`
+	case errors.Is(err, ErrTokenExpiresSoon):
+		return `Bearer error="invalid_token", error_description="The access token expires too soon, refresh it first"`
+	default:
+		return `Bearer error="invalid_token", error_description="The access token is invalid"`
+	}
+}
@@ -0,0 +1,253 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RFC 8693 grant and token types
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// timeout of requests to the token endpoint
+const tokenExchangeTimeout = 10 * time.Second
+
+// maximum size of a token endpoint response read
+const maxTokenExchangeResponseSize = 1 << 20
+
+// how long before they expire exchanged tokens are exchanged again, unless
+// configured otherwise
+const defaultTokenExchangeRefreshBefore = 30 * time.Second
+
+// maximum number of exchanged tokens kept
+const exchangeCacheMaxEntries = 10000
+
+// TokenExchangeConfig enables ExchangeToken, performing RFC 8693 token
+// exchange at the token endpoint found by OIDC discovery
+type TokenExchangeConfig struct {
+	// ClientID and ClientSecret authenticate Tornjak to the token endpoint
+	ClientID     string
+	ClientSecret string
+	// RefreshBefore is how long before they expire exchanged tokens stop
+	// being reused, defaults to 30s
+	RefreshBefore time.Duration
+}
+
+// TokenExchangeRequest narrows the token obtained by ExchangeToken
+type TokenExchangeRequest struct {
+	// Audience, if set, is the service the token is requested for
+	Audience string
+	// Scopes, if any, are the scopes requested
+	Scopes []string
+}
+
+// ExchangedToken is a token obtained by ExchangeToken
+type ExchangedToken struct {
+	AccessToken string
+	// TokenType is how the token is presented, usually Bearer
+	TokenType string
+	// IssuedTokenType is the RFC 8693 type of AccessToken
+	IssuedTokenType string
+	// Scope is the scope granted, if the token endpoint reported it
+	Scope string
+	// ExpiresAt is zero if the token endpoint reported no lifetime
+	ExpiresAt time.Time
+}
+
+// tokenExchangeResponse is the successful response of the token endpoint
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+// tokenExchangeError is the error response of the token endpoint, as
+// defined by RFC 6749
+type tokenExchangeError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// tokenExchanger exchanges tokens, reusing exchanged tokens until shortly
+// before they expire. It is safe for concurrent use.
+type tokenExchanger struct {
+	clientID      string
+	clientSecret  string
+	refreshBefore time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*ExchangedToken
+}
+
+func newTokenExchanger(config *TokenExchangeConfig) *tokenExchanger {
+	if config == nil {
+		return nil
+	}
+	refreshBefore := config.RefreshBefore
+	if refreshBefore == 0 {
+		refreshBefore = defaultTokenExchangeRefreshBefore
+	}
+	return &tokenExchanger{
+		clientID:      config.ClientID,
+		clientSecret:  config.ClientSecret,
+		refreshBefore: refreshBefore,
+		entries:       make(map[[sha256.Size]byte]*ExchangedToken),
+	}
+}
+
+// exchangeCacheKey hashes the subject token along with the request, so that
+// raw tokens are not kept in memory and scopes match in any order
+func exchangeCacheKey(subjectToken string, request TokenExchangeRequest) [sha256.Size]byte {
+	scopes := append([]string{}, request.Scopes...)
+	sort.Strings(scopes)
+	return sha256.Sum256([]byte(subjectToken + "\x00" + request.Audience + "\x00" + strings.Join(scopes, " ")))
+}
+
+// get returns the exchanged token cached for key, unless it is about to
+// expire
+func (e *tokenExchanger) get(key [sha256.Size]byte, now time.Time) (*ExchangedToken, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	token, ok := e.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(token.ExpiresAt.Add(-e.refreshBefore)) {
+		delete(e.entries, key)
+		return nil, false
+	}
+	copied := *token
+	return &copied, true
+}
+
+// put caches an exchanged token with an expiry
+func (e *tokenExchanger) put(key [sha256.Size]byte, token *ExchangedToken, now time.Time) {
+	if token.ExpiresAt.IsZero() || !now.Before(token.ExpiresAt.Add(-e.refreshBefore)) {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.entries) >= exchangeCacheMaxEntries {
+		for key, cached := range e.entries {
+			if !now.Before(cached.ExpiresAt.Add(-e.refreshBefore)) {
+				delete(e.entries, key)
+			}
+		}
+		if len(e.entries) >= exchangeCacheMaxEntries { // still full, skip caching
+			return
+		}
+	}
+	copied := *token
+	e.entries[key] = &copied
+}
+
+// ExchangeToken exchanges subjectToken, a token presented to Tornjak, for
+// one narrowed to the audience and scopes of request, as defined by RFC
+// 8693, so that Tornjak can act on behalf of the user with least
+// privilege. The token endpoint is taken from the discovered metadata.
+// Exchanged tokens are reused for the same subject token and request until
+// shortly before they expire. subjectToken is passed on as is, so it
+// should be authenticated first.
+func (a *KeycloakAuthenticator) ExchangeToken(ctx context.Context, subjectToken string, request TokenExchangeRequest) (*ExchangedToken, error) {
+	if a.exchanger == nil {
+		return nil, errors.New("Token exchange is not configured")
+	}
+	metadata := a.keys.Load().metadata
+	if metadata == nil || metadata.TokenEndpoint == "" {
+		return nil, errors.New("Token exchange requires the token endpoint found by OIDC discovery")
+	}
+	key := exchangeCacheKey(subjectToken, request)
+	if token, ok := a.exchanger.get(key, a.now()); ok {
+		return token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenExchangeTimeout)
+	defer cancel()
+	token, err := a.exchangeToken(ctx, metadata.TokenEndpoint, subjectToken, request)
+	if err != nil {
+		return nil, err
+	}
+	a.exchanger.put(key, token, a.now())
+	return token, nil
+}
+
+// exchangeToken posts the token exchange request to endpoint
+func (a *KeycloakAuthenticator) exchangeToken(ctx context.Context, endpoint string, subjectToken string, request TokenExchangeRequest) (*ExchangedToken, error) {
+	client := a.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	form := url.Values{
+		"grant_type":           {tokenExchangeGrantType},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {accessTokenType},
+		"requested_token_type": {accessTokenType},
+	}
+	if request.Audience != "" {
+		form.Set("audience", request.Audience)
+	}
+	if len(request.Scopes) > 0 {
+		form.Set("scope", strings.Join(request.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Errorf("Could not create request for %s: %v", endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.exchanger.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.exchanger.clientID), url.QueryEscape(a.exchanger.clientSecret))
+	}
+
+	start := a.now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("Error exchanging token at %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenExchangeResponseSize))
+	if err != nil {
+		return nil, errors.Errorf("Error exchanging token at %s: %v", endpoint, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		exchangeErr := tokenExchangeError{}
+		if json.Unmarshal(body, &exchangeErr) == nil && exchangeErr.Error != "" {
+			return nil, errors.Errorf("Error exchanging token at %s: %s: %s", endpoint, exchangeErr.Error, exchangeErr.ErrorDescription)
+		}
+		return nil, errors.Errorf("Error exchanging token at %s: unexpected status %s", endpoint, resp.Status)
+	}
+
+	response := tokenExchangeResponse{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, errors.Errorf("Error decoding token exchange response from %s: %v", endpoint, err)
+	}
+	if response.AccessToken == "" {
+		return nil, errors.Errorf("Token exchange response from %s holds no access token", endpoint)
+	}
+	token := &ExchangedToken{
+		AccessToken:     response.AccessToken,
+		TokenType:       response.TokenType,
+		IssuedTokenType: response.IssuedTokenType,
+		Scope:           response.Scope,
+	}
+	if response.ExpiresIn > 0 {
+		// counted from the request, so that the token never outlives the
+		// expiry assumed
+		token.ExpiresAt = start.Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
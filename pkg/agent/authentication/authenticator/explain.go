@@ -0,0 +1,173 @@
+package authenticator
+
+import (
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// how a RoleMappingMatch was translated
+const (
+	MatchedByTenantMapping = "tenant_mapping"
+	MatchedByRoleMapping   = "role_mapping"
+	MatchedByRolePattern   = "role_pattern"
+	MatchedByScopeMapping  = "scope_mapping"
+	MatchedByGroupMapping  = "group_mapping"
+	MatchedByPassthrough   = "passthrough"
+)
+
+// AuthExplanation describes how a token is interpreted, see Explain
+type AuthExplanation struct {
+	// Claims are the claims of the token, validated only if Rejection is nil
+	Claims *KeycloakClaim
+	// TokenRoles are the roles found at the roles claim and the client
+	// roles, before they are translated
+	TokenRoles []string
+	// RoleMatches tells, for each token role, once stripped of the role
+	// prefix and composite roles expanded, each scope and each group, which
+	// mapping translated it, in order; unmatched ones are dropped
+	RoleMatches []RoleMappingMatch
+	// Roles are the resulting Tornjak roles, including those set by Enrich
+	Roles  []string
+	Tenant string
+	// Rejection is why the token would be rejected, nil if it is accepted;
+	// Reason classifies it like the failures metric
+	Rejection error
+	Reason    string
+}
+
+// RoleMappingMatch tells how a role, scope or group of a token was translated
+type RoleMappingMatch struct {
+	// Role is the token role, or the scope or group if MatchedBy is
+	// scope_mapping or group_mapping
+	Role string
+	// TornjakRole is the role translated to, empty if Role was dropped
+	TornjakRole string
+	// MatchedBy is one of the MatchedBy constants, empty if Role was dropped
+	MatchedBy string
+	// Pattern is the role pattern matched, if MatchedBy is role_pattern, or
+	// the group of the group mapping matched
+	Pattern string
+}
+
+// Explain reports how token would be authenticated with the current
+// configuration, for trying out role mappings or audience changes on a
+// sample token. Unlike AuthenticateToken it leaves the caches, metrics,
+// audit log and replay protection untouched, and does not fetch the roles
+// of the userinfo endpoint. A token rejected by the validation is still
+// explained as far as its claims could be parsed; an error is only
+// returned if token is no JWT at all, or cannot be decrypted.
+func (a *KeycloakAuthenticator) Explain(token string) (*AuthExplanation, error) {
+	signed, err := a.decrypter.decrypt(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := jwt.NewParser().ParseUnverified(signed, &KeycloakClaim{}); err != nil {
+		return nil, newAuthError(ErrInvalidToken, err, "Error parsing token :%s", err.Error())
+	}
+	claims, tenant, tenantRoleMappings, err := a.verifyToken(token, a.params.Load())
+	explanation := &AuthExplanation{
+		Claims:     claims,
+		TokenRoles: a.tokenRoles(claims),
+		Tenant:     tenant,
+	}
+	explanation.RoleMatches, explanation.Roles = a.explainRoles(explanation.TokenRoles, tenantRoleMappings)
+	for _, scope := range strings.Fields(claims.Scope) {
+		match := RoleMappingMatch{Role: scope}
+		if tornjakRole, ok := a.scopeMappings[scope]; ok {
+			match.TornjakRole = tornjakRole
+			match.MatchedBy = MatchedByScopeMapping
+			explanation.Roles = dedupeRoles(append(explanation.Roles, tornjakRole))
+		}
+		explanation.RoleMatches = append(explanation.RoleMatches, match)
+	}
+	if len(a.groupMappings) > 0 {
+		for _, group := range claims.StringsAt(a.groupsClaim) {
+			matched := false
+			for _, mapping := range a.groupMappings {
+				if mapping.matches(normalizeGroupPath(group)) {
+					matched = true
+					explanation.RoleMatches = append(explanation.RoleMatches, RoleMappingMatch{Role: group, TornjakRole: mapping.Role, MatchedBy: MatchedByGroupMapping, Pattern: mapping.Group})
+					explanation.Roles = dedupeRoles(append(explanation.Roles, mapping.Role))
+				}
+			}
+			if !matched {
+				explanation.RoleMatches = append(explanation.RoleMatches, RoleMappingMatch{Role: group})
+			}
+		}
+	}
+
+	// Enrich only depends on the claims, so it is safe to call here
+	if err == nil && a.enrich != nil {
+		userInfo := &user.UserInfo{
+			Roles:             explanation.Roles,
+			Tenant:            tenant,
+			Subject:           claims.Subject,
+			Email:             claims.Email,
+			PreferredUsername: claims.PreferredUsername,
+		}
+		a.enrich(claims, userInfo)
+		explanation.Roles = userInfo.Roles
+	}
+	if err == nil && a.requireRole && len(explanation.Roles) == 0 {
+		err = newAuthError(ErrInsufficientRoles, nil, "Token has no roles mapping to a Tornjak role")
+	}
+	if err != nil {
+		explanation.Rejection = err
+		explanation.Reason = failureReason(err)
+	}
+	return explanation, nil
+}
+
+// VerifySignatureOnly checks that token, decrypted if it is a JWE, was
+// signed with an allowed algorithm by a trusted key, returning its claims.
+// No claim is validated: expired tokens, tokens of other issuers or
+// audiences and tokens without roles are accepted, so it is UNSAFE for
+// access control. It is meant for inspecting tokens, such as old ones, and
+// leaves the caches, metrics and audit log untouched; use AuthenticateRequest
+// or AuthenticateToken to authenticate users.
+func (a *KeycloakAuthenticator) VerifySignatureOnly(token string) (*KeycloakClaim, error) {
+	signed, err := a.decrypter.decrypt(token)
+	if err != nil {
+		return nil, err
+	}
+	claims := &KeycloakClaim{}
+	jwtToken, err := jwt.ParseWithClaims(signed, claims, a.keyFunc(a.keys.Load()), jwt.WithValidMethods(a.allowedAlgs), jwt.WithoutClaimsValidation())
+	if err != nil && !algorithmAllowed(jwtToken, a.allowedAlgs) {
+		return nil, newAuthError(ErrInvalidToken, err, "Token signing algorithm %v is not allowed, expected one of %v", jwtToken.Header["alg"], a.allowedAlgs)
+	}
+	if err != nil {
+		return nil, newAuthError(ErrInvalidToken, err, "Error verifying token signature: %v", err)
+	}
+	return claims, nil
+}
+
+// explainRoles translates roles like translateRoles, telling which mapping
+// matched each, without counting or logging unmapped roles
+func (a *KeycloakAuthenticator) explainRoles(roles []string, tenantRoleMappings map[string]string) ([]RoleMappingMatch, []string) {
+	roles = a.expandCompositeRoles(a.stripRolePrefix(roles))
+	roleMappings := a.RoleMappings()
+	passthrough := len(roleMappings) == 0 && len(tenantRoleMappings) == 0 && len(a.rolePatterns) == 0
+	matches := make([]RoleMappingMatch, 0, len(roles))
+	tornjakRoles := []string{}
+	for _, role := range roles {
+		match := RoleMappingMatch{Role: role}
+		if passthrough {
+			match.TornjakRole, match.MatchedBy = role, MatchedByPassthrough
+		} else if tornjakRole, ok := tenantRoleMappings[role]; ok {
+			match.TornjakRole, match.MatchedBy = tornjakRole, MatchedByTenantMapping
+		} else if tornjakRole, pattern, ok := a.mapRole(roleMappings, role); ok {
+			match.TornjakRole, match.MatchedBy, match.Pattern = tornjakRole, MatchedByRoleMapping, pattern
+			if pattern != "" {
+				match.MatchedBy = MatchedByRolePattern
+			}
+		}
+		if match.TornjakRole != "" {
+			tornjakRoles = append(tornjakRoles, match.TornjakRole)
+		}
+		matches = append(matches, match)
+	}
+	return matches, dedupeRoles(tornjakRoles)
+}
@@ -0,0 +1,94 @@
+package authenticator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// default claim path at which group paths are found in the token
+const defaultGroupsClaim = "groups"
+
+// GroupMatch selects how a GroupMapping matches the groups of a token
+type GroupMatch string
+
+const (
+	// GroupMatchPath matches the full group path, e.g. /platform/tornjak/admins
+	GroupMatchPath GroupMatch = "path"
+	// GroupMatchLeaf matches the name of the group, the last path segment,
+	// e.g. admins, in whatever parent group
+	GroupMatchLeaf GroupMatch = "leaf"
+	// GroupMatchPrefix matches the group and every group nested in it, e.g.
+	// /platform/tornjak matches /platform/tornjak/admins but not
+	// /platform/tornjak-dev
+	GroupMatchPrefix GroupMatch = "prefix"
+)
+
+// GroupMapping maps the members of a group to a Tornjak role
+type GroupMapping struct {
+	// Group is the group path, or the group name with GroupMatchLeaf
+	Group string
+	// Match defaults to GroupMatchPath
+	Match GroupMatch
+	Role  string
+}
+
+// validate returns the problem of the mapping, if any
+func (m GroupMapping) validate() string {
+	switch {
+	case m.Role == "":
+		return fmt.Sprintf("group mapping of %q has no role", m.Group)
+	case m.Match == GroupMatchLeaf:
+		if m.Group == "" || strings.Contains(m.Group, "/") {
+			return fmt.Sprintf("group name %q of a leaf group mapping must be a single path segment", m.Group)
+		}
+	case m.Match == "" || m.Match == GroupMatchPath || m.Match == GroupMatchPrefix:
+		if normalizeGroupPath(m.Group) == "/" {
+			return fmt.Sprintf("group path %q of a group mapping is empty", m.Group)
+		}
+	default:
+		return fmt.Sprintf("group mapping of %q has unknown match %q, expected path, leaf or prefix", m.Group, m.Match)
+	}
+	return ""
+}
+
+// matches reports whether the group at the normalized path groupPath is
+// mapped
+func (m GroupMapping) matches(groupPath string) bool {
+	switch m.Match {
+	case GroupMatchLeaf:
+		return groupPath[strings.LastIndex(groupPath, "/")+1:] == m.Group
+	case GroupMatchPrefix:
+		prefix := normalizeGroupPath(m.Group)
+		return groupPath == prefix || strings.HasPrefix(groupPath, prefix+"/")
+	default:
+		return groupPath == normalizeGroupPath(m.Group)
+	}
+}
+
+// normalizeGroupPath returns the group path with a single leading slash and
+// no trailing or repeated slashes, so that "/platform/tornjak/admins",
+// "platform/tornjak/admins/" and the bare name of a top-level group, as
+// emitted by Keycloak without full group paths, compare alike
+func normalizeGroupPath(group string) string {
+	segments := strings.FieldsFunc(group, func(r rune) bool { return r == '/' })
+	return "/" + strings.Join(segments, "/")
+}
+
+// groupRoles maps the groups of the token to Tornjak roles using the
+// configured group mappings, each matching group adding the roles of every
+// mapping it matches
+func (a *KeycloakAuthenticator) groupRoles(claims *KeycloakClaim) []string {
+	if len(a.groupMappings) == 0 {
+		return nil
+	}
+	roles := []string{}
+	for _, group := range claims.StringsAt(a.groupsClaim) {
+		groupPath := normalizeGroupPath(group)
+		for _, mapping := range a.groupMappings {
+			if mapping.matches(groupPath) {
+				roles = append(roles, mapping.Role)
+			}
+		}
+	}
+	return dedupeRoles(roles)
+}
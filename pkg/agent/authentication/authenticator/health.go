@@ -0,0 +1,160 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	keyfunc "github.com/MicahParks/keyfunc/v2"
+	"github.com/pkg/errors"
+)
+
+// HealthChecker is implemented by authenticators that can report whether
+// they are able to authenticate requests
+type HealthChecker interface {
+	// Healthy returns an error if requests cannot currently be authenticated
+	Healthy() error
+}
+
+var (
+	_ HealthChecker = (*KeycloakAuthenticator)(nil)
+	_ HealthChecker = (*MultiIssuerAuthenticator)(nil)
+	_ HealthChecker = (*ChainAuthenticator)(nil)
+)
+
+// JWKSRefreshStatus describes the failures of background JWKS refreshes
+type JWKSRefreshStatus struct {
+	// LastError is the error of the most recent refresh, nil if it succeeded
+	LastError error
+	// LastErrorAt is when the most recent refresh failed
+	LastErrorAt time.Time
+	// FailingSince is when refreshes started failing without a success since
+	FailingSince time.Time
+}
+
+// jwksRefreshStatus records the outcome of the most recent JWKS refresh
+type jwksRefreshStatus struct {
+	mu             sync.Mutex
+	status         JWKSRefreshStatus
+	unhealthyAfter time.Duration
+	// cache lifetime given by the headers of the last fetched JWKS, if any
+	lifetime    time.Duration
+	hasLifetime bool
+	// failures holds one pending notification of a failed refresh
+	failures chan struct{}
+}
+
+func newJWKSRefreshStatus(unhealthyAfter time.Duration) *jwksRefreshStatus {
+	return &jwksRefreshStatus{
+		unhealthyAfter: unhealthyAfter,
+		failures:       make(chan struct{}, 1),
+	}
+}
+
+func (s *jwksRefreshStatus) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.status.LastError == nil {
+		s.status.FailingSince = now
+	}
+	s.status.LastError = err
+	s.status.LastErrorAt = now
+	select {
+	case s.failures <- struct{}{}:
+	default:
+	}
+}
+
+func (s *jwksRefreshStatus) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = JWKSRefreshStatus{}
+}
+
+func (s *jwksRefreshStatus) cacheLifetime() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lifetime, s.hasLifetime
+}
+
+func (s *jwksRefreshStatus) get() JWKSRefreshStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// err returns the last refresh error once refreshes have been failing
+// for longer than unhealthyAfter
+func (s *jwksRefreshStatus) err() error {
+	status := s.get()
+	if status.LastError == nil || time.Since(status.FailingSince) < s.unhealthyAfter {
+		return nil
+	}
+	return status.LastError
+}
+
+// responseExtractor marks a refresh as succeeded once the JWKS was fetched,
+// recording the cache lifetime of the response; a failure to parse it is
+// reported afterwards to the RefreshErrorHandler
+func (s *jwksRefreshStatus) responseExtractor(ctx context.Context, resp *http.Response) (json.RawMessage, error) {
+	raw, err := keyfunc.ResponseExtractorStatusOK(ctx, resp)
+	if err == nil {
+		s.succeeded()
+		lifetime, ok := cacheLifetime(resp.Header, time.Now())
+		s.mu.Lock()
+		s.lifetime, s.hasLifetime = lifetime, ok
+		s.mu.Unlock()
+	}
+	return raw, err
+}
+
+// JWKSRefreshStatus returns the failures of background JWKS refreshes,
+// for example for a metrics exporter. It is zero when tokens are verified
+// with an HMAC secret.
+func (a *KeycloakAuthenticator) JWKSRefreshStatus() JWKSRefreshStatus {
+	if a.refreshStatus == nil {
+		return JWKSRefreshStatus{}
+	}
+	return a.refreshStatus.get()
+}
+
+// Healthy returns an error if the JWKS holds no keys or its background
+// refreshes have been failing for longer than JWKSConfig.UnhealthyAfter
+func (a *KeycloakAuthenticator) Healthy() error {
+	jwks := a.keys.Load().jwks
+	if jwks == nil { // HMAC secret
+		return nil
+	}
+	if jwks.Len() == 0 {
+		return errors.New("JWKS has no keys")
+	}
+	if err := a.refreshStatus.err(); err != nil {
+		return errors.Errorf("Last JWKS refresh failed: %v", err)
+	}
+	return nil
+}
+
+// Healthy returns an error if the authenticator of any issuer is not healthy
+func (a *MultiIssuerAuthenticator) Healthy() error {
+	for issuer, authenticator := range a.issuers {
+		if err := authenticator.Healthy(); err != nil {
+			return errors.Errorf("Issuer %s: %v", issuer, err)
+		}
+	}
+	return nil
+}
+
+// Healthy returns an error if any authenticator of the chain is not healthy
+func (a *ChainAuthenticator) Healthy() error {
+	for _, authenticator := range a.authenticators {
+		if checker, ok := authenticator.(HealthChecker); ok {
+			if err := checker.Healthy(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
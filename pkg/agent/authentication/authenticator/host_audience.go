@@ -0,0 +1,53 @@
+package authenticator
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// normalizeHost returns the host of a Host header or HostAudiences key in
+// lower case, without port
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// requestHost returns the normalized host r is for if audiences are
+// expected per host, empty otherwise or if r is nil
+func (a *KeycloakAuthenticator) requestHost(r *http.Request) string {
+	if a.hostAudiences == nil || r == nil {
+		return ""
+	}
+	return normalizeHost(r.Host)
+}
+
+// requestParams returns the validation parameters of tokens presented with
+// r: with the audience of its host if audiences are expected per host,
+// rejecting hosts without one, otherwise the configured ones
+func (a *KeycloakAuthenticator) requestParams(r *http.Request) (*validationParams, error) {
+	params := a.params.Load()
+	if a.hostAudiences == nil || r == nil {
+		return params, nil
+	}
+	host := a.requestHost(r)
+	audience, ok := a.hostAudiences[host]
+	if !ok {
+		return nil, newAuthError(ErrInvalidToken, jwt.ErrTokenInvalidAudience, "No audience is configured for host %q", host)
+	}
+	return &validationParams{issuer: params.issuer, audiences: []string{audience}, generation: params.generation}, nil
+}
+
+// tokenCacheKey returns the key a token is cached by: the token itself, or
+// along with the host it was presented for, as the expected audience
+// depends on it
+func tokenCacheKey(token string, host string) string {
+	if host == "" {
+		return token
+	}
+	return token + "\x00" + host
+}
@@ -0,0 +1,209 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// timeout of introspection requests if no HTTPClient is configured
+const defaultIntrospectionTimeout = 10 * time.Second
+
+// maximum size of an introspection response read
+const maxIntrospectionResponseSize = 1 << 20
+
+// IntrospectionConfig holds the options for an IntrospectionAuthenticator
+type IntrospectionConfig struct {
+	// Endpoint is the URL of the RFC 7662 token introspection endpoint
+	Endpoint string
+	// ClientID and ClientSecret authenticate Tornjak to the endpoint
+	ClientID     string
+	ClientSecret string
+	// HTTPClient is used for introspection requests, defaults to a
+	// client with a timeout of 10 seconds
+	HTTPClient *http.Client
+	// TLS configures the default client; it cannot be combined with HTTPClient
+	TLS TLSConfig
+	// RolesClaim is the dot separated path to the roles in the
+	// introspection response, defaults to "realm_access.roles"
+	RolesClaim string
+	// RoleMappings maps the roles and the scopes of a token to Tornjak
+	// roles; nil passes both through
+	RoleMappings map[string]string
+	// DisableTokenCache turns off caching of active tokens until they expire
+	DisableTokenCache bool
+}
+
+// IntrospectionAuthenticator authenticates opaque tokens by asking the
+// issuer whether they are active, as defined by RFC 7662
+type IntrospectionAuthenticator struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	rolesClaim   string
+	roleMappings map[string]string
+	tokenCache   *tokenCache
+}
+
+// introspectionResponse holds the members of an introspection response not
+// shared with access token claims
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	Username string `json:"username"`
+}
+
+func NewIntrospectionAuthenticator(config IntrospectionConfig) (*IntrospectionAuthenticator, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("An introspection endpoint is required")
+	}
+	client, err := newHTTPClient(config.HTTPClient, config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = &http.Client{Timeout: defaultIntrospectionTimeout}
+	}
+	rolesClaim := config.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = defaultRolesClaim
+	}
+	var cache *tokenCache
+	if !config.DisableTokenCache {
+		cache = newTokenCache()
+	}
+	return &IntrospectionAuthenticator{
+		endpoint:     config.Endpoint,
+		clientID:     config.ClientID,
+		clientSecret: config.ClientSecret,
+		client:       client,
+		rolesClaim:   rolesClaim,
+		roleMappings: config.RoleMappings,
+		tokenCache:   cache,
+	}, nil
+}
+
+func (a *IntrospectionAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	userInfo, _ := a.AuthenticateRequestContext(r.Context(), r)
+	return userInfo
+}
+
+// AuthenticateRequestContext authenticates r like AuthenticateRequest,
+// introspecting the token within ctx
+func (a *IntrospectionAuthenticator) AuthenticateRequestContext(ctx context.Context, r *http.Request) (*user.UserInfo, error) {
+	userInfo := a.authenticateRequest(ctx, r)
+	return userInfo, userInfo.AuthenticationError
+}
+
+func (a *IntrospectionAuthenticator) authenticateRequest(ctx context.Context, r *http.Request) *user.UserInfo {
+	token, err := getToken(r, "", "", nil)
+	if err != nil {
+		return wrapAuthenticationError(err)
+	}
+	if a.tokenCache != nil {
+		if userInfo, ok := a.tokenCache.get(token); ok {
+			return userInfo
+		}
+	}
+
+	response, claims, err := a.introspect(ctx, token)
+	if err != nil {
+		return wrapAuthenticationError(newAuthError(ErrInvalidToken, err, "Error introspecting token: %v", err))
+	}
+	if !response.Active {
+		return wrapAuthenticationError(newAuthError(ErrInvalidToken, nil, "Token is not active"))
+	}
+
+	roles := claims.StringsAt(a.rolesClaim)
+	roles = append(roles, strings.Fields(response.Scope)...)
+	username := claims.PreferredUsername
+	if username == "" {
+		username = response.Username
+	}
+	userInfo := &user.UserInfo{
+		Roles:             a.translateRoles(dedupeRoles(roles)),
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		PreferredUsername: username,
+	}
+	if claims.ExpiresAt != nil {
+		userInfo.ExpiresAt = claims.ExpiresAt.Time
+	}
+
+	// cache active tokens, never past their reported expiry
+	if a.tokenCache != nil && claims.ExpiresAt != nil {
+		a.tokenCache.put(token, userInfo, claims.ExpiresAt.Time)
+	}
+	return userInfo
+}
+
+// introspect posts token to the introspection endpoint and decodes the response
+func (a *IntrospectionAuthenticator) introspect(ctx context.Context, token string) (*introspectionResponse, *KeycloakClaim, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIntrospectionResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response := &introspectionResponse{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, nil, errors.Errorf("could not decode introspection response: %v", err)
+	}
+	claims := &KeycloakClaim{}
+	if response.Active {
+		if err := json.Unmarshal(body, claims); err != nil {
+			return nil, nil, errors.Errorf("could not decode introspection response: %v", err)
+		}
+	}
+	return response, claims, nil
+}
+
+// translateRoles maps roles and scopes to Tornjak roles, dropping those
+// without a mapping. If no role mappings are configured, they are passed
+// through unchanged.
+func (a *IntrospectionAuthenticator) translateRoles(roles []string) []string {
+	if len(a.roleMappings) == 0 {
+		return roles
+	}
+	tornjakRoles := []string{}
+	for _, role := range roles {
+		if tornjakRole, ok := a.roleMappings[role]; ok {
+			tornjakRoles = append(tornjakRoles, tornjakRole)
+		}
+	}
+	return dedupeRoles(tornjakRoles)
+}
+
+func (a *IntrospectionAuthenticator) Close() error {
+	return nil
+}
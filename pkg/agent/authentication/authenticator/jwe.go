@@ -0,0 +1,69 @@
+package authenticator
+
+import (
+	"crypto/rsa"
+	"strings"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// key management and content encryption algorithms of the JWE tokens
+// decrypted
+var (
+	jweKeyAlgorithms        = []jose.KeyAlgorithm{jose.RSA_OAEP, jose.RSA_OAEP_256}
+	jweContentEncryptions   = []jose.ContentEncryption{jose.A256GCM}
+	jweKeyAlgorithmNames    = []string{string(jose.RSA_OAEP), string(jose.RSA_OAEP_256)}
+	jweContentEncryptionAlg = string(jose.A256GCM)
+)
+
+// ParseDecryptionKeyPEM parses a PEM encoded RSA private key, in PKCS #1 or
+// PKCS #8 form, for KeycloakConfig.DecryptionKey
+func ParseDecryptionKeyPEM(pem []byte) (*rsa.PrivateKey, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, errors.Errorf("Could not parse decryption key: %v", err)
+	}
+	return key, nil
+}
+
+// tokenDecrypter decrypts JWE tokens to the signed JWT they wrap
+type tokenDecrypter struct {
+	key      *rsa.PrivateKey
+	required bool // tokens that are not JWE are rejected
+}
+
+// newTokenDecrypter returns the decrypter configured by config, nil if
+// tokens are not decrypted
+func newTokenDecrypter(config KeycloakConfig) *tokenDecrypter {
+	if config.DecryptionKey == nil {
+		return nil
+	}
+	return &tokenDecrypter{key: config.DecryptionKey, required: config.RequireEncryption}
+}
+
+// decrypt returns the signed JWT wrapped by token if it is a JWE in compact
+// serialization, otherwise token itself unless encryption is required. A
+// nil decrypter returns every token unchanged.
+func (d *tokenDecrypter) decrypt(token string) (string, error) {
+	if d == nil {
+		return token, nil
+	}
+	// a JWE has five parts, a JWS three
+	if strings.Count(token, ".") != 4 {
+		if d.required {
+			return "", newAuthError(ErrInvalidToken, nil, "Token is not encrypted, an encrypted JWE token is required")
+		}
+		return token, nil
+	}
+	encrypted, err := jose.ParseEncryptedCompact(token, jweKeyAlgorithms, jweContentEncryptions)
+	if err != nil {
+		return "", newAuthError(ErrInvalidToken, err, "Error parsing encrypted token, expected a JWE with key algorithm %v and content encryption %s: %v", jweKeyAlgorithmNames, jweContentEncryptionAlg, err)
+	}
+	plaintext, err := encrypted.Decrypt(d.key)
+	if err != nil {
+		return "", newAuthError(ErrInvalidToken, err, "Could not decrypt token: %v", err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,100 @@
+package authenticator
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// longest refresh interval taken from the cache headers of a JWKS response,
+// so that a far future expiry does not stop refreshes
+const maxJWKSCacheLifetime = 24 * time.Hour
+
+// cacheLifetime returns how long a response may be cached according to its
+// Cache-Control max-age, or else its Expires header. no-cache and no-store
+// yield zero. ok is false if the headers do not say.
+func cacheLifetime(header http.Header, now time.Time) (lifetime time.Duration, ok bool) {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-cache", "no-store":
+				return 0, true
+			case "max-age":
+				seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+				if err == nil && seconds >= 0 {
+					return time.Duration(seconds) * time.Second, true
+				}
+			}
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expiry, err := http.ParseTime(expires)
+		if err != nil { // invalid dates such as "0" mean already expired
+			return 0, true
+		}
+		if lifetime := expiry.Sub(now); lifetime > 0 {
+			return lifetime, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// cacheHeaderRefreshInterval returns when to refresh the JWKS next: after
+// lifetime if known, at least the refresh rate limit and at most a day,
+// otherwise after the configured refresh interval
+func (c JWKSConfig) cacheHeaderRefreshInterval(lifetime time.Duration, ok bool) time.Duration {
+	if !ok {
+		if c.RefreshInterval != 0 {
+			return c.RefreshInterval
+		}
+		return defaultJWKSRefreshInterval
+	}
+	minInterval := c.RefreshRateLimit
+	if minInterval == 0 {
+		minInterval = defaultJWKSRefreshRateLimit
+	}
+	if lifetime < minInterval {
+		return minInterval
+	}
+	if lifetime > maxJWKSCacheLifetime {
+		return maxJWKSCacheLifetime
+	}
+	return lifetime
+}
+
+// refreshOnCacheHeaders refreshes the JWKS, until Close, whenever the cache
+// lifetime of the last fetched response ends. A failed refresh is retried
+// with the configured backoff, or else after the refresh rate limit.
+func (a *KeycloakAuthenticator) refreshOnCacheHeaders(config JWKSConfig) {
+	a.runInBackground(func(ctx context.Context) {
+		retryBackOff := config.retryBackOff()
+		wait := config.cacheHeaderRefreshInterval(a.refreshStatus.cacheLifetime())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			if err := a.RefreshJWKS(ctx); err != nil {
+				if ctx.Err() != nil { // closed during the refresh
+					return
+				}
+				a.refreshStatus.failed(err)
+				wait = config.cacheHeaderRefreshInterval(0, true)
+				if retryBackOff != nil {
+					wait = retryBackOff.NextBackOff()
+				}
+				a.logger.Warnf("Scheduled JWKS refresh failed, retrying in %v: %v", wait, err)
+				continue
+			}
+			if retryBackOff != nil {
+				retryBackOff.Reset()
+			}
+			wait = config.cacheHeaderRefreshInterval(a.refreshStatus.cacheLifetime())
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package authenticator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	keyfunc "github.com/MicahParks/keyfunc/v2"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// NewKeycloakAuthenticatorWithJWKSFile returns an authenticator verifying
+// tokens with the JWKS read from a local file, for environments where no
+// JWKS URL is reachable. No OIDC discovery is performed. If watch is set,
+// the JWKS is reloaded whenever the file changes.
+func NewKeycloakAuthenticatorWithJWKSFile(path string, watch bool, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false); err != nil {
+		return nil, err
+	}
+	keys, err := loadJWKSFile(path, config.JWKS.AllowEmpty)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newKeycloakAuthenticator(keys, allowedAlgs, config)
+	if keys.jwks.Len() == 0 {
+		a.logger.Warnf("JWKS file %s has no usable keys: tokens are rejected until a reload finds keys", path)
+	}
+	a.refreshStatus = newJWKSRefreshStatus(config.JWKS.UnhealthyAfter)
+	if watch {
+		a.keyRotation = newKeyRotation()
+		a.keyRotation.observe(keys.jwks.RawJWKS())
+		if err := a.watchJWKSFile(path); err != nil {
+			return nil, err
+		}
+		a.watchKeyRotation(config.JWKS.OnKeyRotation)
+	}
+	return a, nil
+}
+
+// loadJWKSFile builds the keys from the JWKS file at path, failing if it
+// holds no usable keys unless allowEmpty is set
+func loadJWKSFile(path string, allowEmpty bool) (*keySource, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("Could not read JWKS file %s: %v", path, err)
+	}
+	jwks, err := keyfunc.NewJSON(raw)
+	if err != nil {
+		return nil, errors.Errorf("Could not create Keyfunc for file %s: %v", path, err)
+	}
+	if jwks.Len() == 0 && !allowEmpty {
+		return nil, errors.Errorf("JWKS file %s has no usable keys", path)
+	}
+	return &keySource{
+		jwks:    jwks,
+		keyFunc: asymmetricKeyfunc(jwks.Keyfunc),
+	}, nil
+}
+
+// watchJWKSFile reloads the JWKS whenever its file changes, until Close.
+// The directory is watched rather than the file, so that files replaced by
+// renames, as Kubernetes does for mounted volumes, are followed. A failed
+// reload, including one finding no usable keys, is logged and the last
+// loaded keys are kept.
+func (a *KeycloakAuthenticator) watchJWKSFile(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Errorf("Could not watch JWKS file %s: %v", path, err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return errors.Errorf("Could not watch JWKS file %s: %v", path, err)
+	}
+
+	a.runInBackground(func(ctx context.Context) {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				a.logger.Errorf("Error watching JWKS file %s: %v", path, err)
+			case <-watcher.Events:
+				keys, err := loadJWKSFile(path, false)
+				if err != nil {
+					a.refreshStatus.failed(err)
+					a.logger.Errorf("Could not reload JWKS, keeping last loaded keys: %v", err)
+					continue
+				}
+				a.keys.Store(keys)
+				a.refreshStatus.succeeded()
+				a.keyRotation.observe(keys.jwks.RawJWKS())
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,86 @@
+package authenticator
+
+import (
+	"context"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// defaults for retries of failed JWKS refreshes, used when not set in JWKSConfig
+const (
+	defaultJWKSRetryMaxInterval = 5 * time.Minute
+	defaultJWKSRetryJitter      = 0.5
+)
+
+// retryBackOff returns the backoff between retries of failed refreshes,
+// nil if retries are not configured
+func (c JWKSConfig) retryBackOff() *backoff.ExponentialBackOff {
+	if c.RetryInitialInterval == 0 {
+		return nil
+	}
+	retryBackOff := backoff.NewExponentialBackOff()
+	retryBackOff.InitialInterval = c.RetryInitialInterval
+	retryBackOff.MaxInterval = c.RetryMaxInterval
+	if retryBackOff.MaxInterval == 0 {
+		retryBackOff.MaxInterval = defaultJWKSRetryMaxInterval
+	}
+	retryBackOff.RandomizationFactor = c.RetryJitter
+	if retryBackOff.RandomizationFactor == 0 {
+		retryBackOff.RandomizationFactor = defaultJWKSRetryJitter
+	}
+	retryBackOff.MaxElapsedTime = 0 // retry until a refresh succeeds
+	retryBackOff.Reset()
+	return retryBackOff
+}
+
+// scheduleJWKSRefreshes starts the refreshes of the JWKS fetched from a URL
+// that keyfunc does not perform: on cache headers, or retries of failed
+// refreshes, if configured
+func (a *KeycloakAuthenticator) scheduleJWKSRefreshes(config JWKSConfig) {
+	switch {
+	case config.DisableRefresh:
+	case config.RespectCacheHeaders:
+		a.refreshOnCacheHeaders(config)
+	case config.RetryInitialInterval > 0:
+		a.retryFailedJWKSRefreshes(config)
+	}
+}
+
+// retryFailedJWKSRefreshes refreshes the JWKS after each failed refresh,
+// until one succeeds, with exponential backoff and jitter, and starts over
+// with the initial interval on the next failure. It runs until Close.
+func (a *KeycloakAuthenticator) retryFailedJWKSRefreshes(config JWKSConfig) {
+	a.runInBackground(func(ctx context.Context) {
+		retryBackOff := config.retryBackOff()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.refreshStatus.failures:
+			}
+
+			for {
+				wait := retryBackOff.NextBackOff()
+				a.logger.Warnf("JWKS refresh failed, retrying in %v", wait)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				if err := a.RefreshJWKS(ctx); err == nil {
+					break
+				}
+				if ctx.Err() != nil { // closed during the refresh
+					return
+				}
+			}
+			retryBackOff.Reset()
+			// failures of the retries themselves were signaled as well
+			select {
+			case <-a.refreshStatus.failures:
+			default:
+			}
+		}
+	})
+}
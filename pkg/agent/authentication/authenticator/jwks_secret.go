@@ -0,0 +1,180 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	keyfunc "github.com/MicahParks/keyfunc/v2"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// key of the JWKS in a Secret when none is configured
+const defaultJWKSSecretKey = "jwks.json"
+
+// how long to wait before watching a Secret again once the watch failed
+const jwksSecretRewatchDelay = 5 * time.Second
+
+var secretsResource = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// SecretRef names the key of a Kubernetes Secret
+type SecretRef struct {
+	Namespace string
+	Name      string
+	// Key holds the JWKS in the data of the Secret, defaults to "jwks.json"
+	Key string
+}
+
+func (s SecretRef) String() string {
+	return s.Namespace + "/" + s.Name
+}
+
+// NewKeycloakAuthenticatorWithJWKSSecret returns an authenticator verifying
+// tokens with the JWKS held by a Kubernetes Secret, read with the in-cluster
+// client, for clusters distributing signing keys as Secrets rather than
+// serving a JWKS URL. No OIDC discovery is performed. If watch is set, the
+// JWKS is reloaded whenever the Secret changes.
+func NewKeycloakAuthenticatorWithJWKSSecret(ctx context.Context, secret SecretRef, watch bool, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	// assume in-cluster
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Errorf("error with in-cluster config: %v", err)
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Errorf("error creating kube client: %v", err)
+	}
+	return newKeycloakAuthenticatorWithJWKSSecret(ctx, client, secret, watch, config)
+}
+
+func newKeycloakAuthenticatorWithJWKSSecret(ctx context.Context, client dynamic.Interface, secret SecretRef, watch bool, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	if secret.Namespace == "" || secret.Name == "" {
+		return nil, errors.New("The namespace and name of the JWKS Secret are required")
+	}
+	if secret.Key == "" {
+		secret.Key = defaultJWKSSecretKey
+	}
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false); err != nil {
+		return nil, err
+	}
+	secrets := client.Resource(secretsResource).Namespace(secret.Namespace)
+	object, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Errorf("Could not read JWKS Secret %s: %v", secret, err)
+	}
+	keys, raw, err := loadJWKSSecret(object, secret, config.JWKS.AllowEmpty)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newKeycloakAuthenticator(keys, allowedAlgs, config)
+	if keys.jwks.Len() == 0 {
+		a.logger.Warnf("JWKS Secret %s has no usable keys: tokens are rejected until a reload finds keys", secret)
+	}
+	a.refreshStatus = newJWKSRefreshStatus(config.JWKS.UnhealthyAfter)
+	if watch {
+		a.keyRotation = newKeyRotation()
+		a.keyRotation.observe(raw)
+		a.watchJWKSSecret(secrets, secret)
+		a.watchKeyRotation(config.JWKS.OnKeyRotation)
+	}
+	return a, nil
+}
+
+// loadJWKSSecret builds the keys from the JWKS at secret.Key of object,
+// also returning the raw JWKS, which keyfunc.NewJSON does not keep. It
+// fails if the JWKS holds no usable keys unless allowEmpty is set.
+func loadJWKSSecret(object *unstructured.Unstructured, secret SecretRef, allowEmpty bool) (*keySource, []byte, error) {
+	encoded, found, err := unstructured.NestedString(object.Object, "data", secret.Key)
+	if err != nil || !found {
+		return nil, nil, errors.Errorf("JWKS Secret %s has no key %q", secret, secret.Key)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, errors.Errorf("Could not decode key %q of JWKS Secret %s: %v", secret.Key, secret, err)
+	}
+	jwks, err := keyfunc.NewJSON(raw)
+	if err != nil {
+		return nil, nil, errors.Errorf("Could not create Keyfunc for JWKS Secret %s: %v", secret, err)
+	}
+	if jwks.Len() == 0 && !allowEmpty {
+		return nil, nil, errors.Errorf("JWKS Secret %s has no usable keys", secret)
+	}
+	return &keySource{
+		jwks:    jwks,
+		keyFunc: asymmetricKeyfunc(jwks.Keyfunc),
+	}, raw, nil
+}
+
+// watchJWKSSecret reloads the JWKS whenever the Secret changes, until
+// Close. A failed reload, including one finding no usable keys, or the
+// Secret being deleted, is logged and the last loaded keys are kept. A
+// watch ended by the API server is started again.
+func (a *KeycloakAuthenticator) watchJWKSSecret(secrets dynamic.ResourceInterface, secret SecretRef) {
+	a.runInBackground(func(ctx context.Context) {
+		for {
+			watcher, err := secrets.Watch(ctx, metav1.ListOptions{FieldSelector: "metadata.name=" + secret.Name})
+			if err != nil {
+				a.logger.Errorf("Error watching JWKS Secret %s: %v", secret, err)
+			} else {
+				a.handleJWKSSecretEvents(ctx, watcher, secret)
+				watcher.Stop()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jwksSecretRewatchDelay):
+			}
+		}
+	})
+}
+
+// handleJWKSSecretEvents reloads the JWKS on each change of the Secret
+// until ctx is done or the watch ends
+func (a *KeycloakAuthenticator) handleJWKSSecretEvents(ctx context.Context, watcher watch.Interface, secret SecretRef) {
+	for {
+		var event watch.Event
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			event = e
+		}
+
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			object, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			keys, raw, err := loadJWKSSecret(object, secret, false)
+			if err != nil {
+				a.refreshStatus.failed(err)
+				a.logger.Errorf("Could not reload JWKS, keeping last loaded keys: %v", err)
+				continue
+			}
+			a.keys.Store(keys)
+			a.refreshStatus.succeeded()
+			a.keyRotation.observe(raw)
+		case watch.Deleted:
+			err := errors.Errorf("JWKS Secret %s was deleted", secret)
+			a.refreshStatus.failed(err)
+			a.logger.Errorf("%v, keeping last loaded keys", err)
+		case watch.Error:
+			a.logger.Errorf("Error watching JWKS Secret %s: %v", secret, event.Object)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package authenticator
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NewKeycloakAuthenticatorWithJWKSURLs returns an authenticator verifying
+// tokens with the JWKS fetched from the first of urls that serves one, in
+// order of priority, e.g. the JWKS endpoints of independent clusters of the
+// IAM System. No OIDC discovery is performed. The JWKS is refreshed in the
+// background as configured by KeycloakConfig.JWKS; when a refresh fails,
+// urls are tried again in order and the first serving a JWKS is switched to.
+// While another than the first URL is in use, those of higher priority are
+// tried every refresh interval, so that the first is switched back to once
+// it serves a JWKS again.
+func NewKeycloakAuthenticatorWithJWKSURLs(urls []string, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("At least one JWKS URL is required")
+	}
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false, urls...); err != nil {
+		return nil, err
+	}
+	client, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	logger := loggerOrDefault(config.Logger)
+
+	// refresh errors of the JWKS in use trigger a failover
+	refreshFailed := make(chan struct{}, 1)
+	jwksConfig := config.JWKS
+	jwksConfig.RefreshErrorHandler = func(err error) {
+		select {
+		case refreshFailed <- struct{}{}:
+		default:
+		}
+		if config.JWKS.RefreshErrorHandler != nil {
+			config.JWKS.RefreshErrorHandler(err)
+			return
+		}
+		logger.Errorf("error with jwt.Keyfunc: %v", err)
+	}
+	refreshStatus := newJWKSRefreshStatus(config.JWKS.UnhealthyAfter)
+	rotation := newKeyRotation()
+	newKeySource := func(urls []string) (*keySource, error) {
+		return fetchFirstJWKS(urls, jwksConfig, client, refreshStatus, rotation, logger)
+	}
+	keys, err := newKeySource(urls)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newKeycloakAuthenticator(keys, allowedAlgs, config)
+	a.refreshStatus = refreshStatus
+	a.keyRotation = rotation
+	a.handleKeyRotation(config.JWKS)
+	a.scheduleJWKSRefreshes(config.JWKS)
+	// without background refreshes, failures are returned by RefreshJWKS
+	if config.JWKS.refreshesInBackground() {
+		failbackInterval := config.JWKS.RefreshInterval
+		if failbackInterval == 0 {
+			failbackInterval = defaultJWKSRefreshInterval
+		}
+		a.startJWKSFailover(urls, failbackInterval, refreshFailed, newKeySource)
+	}
+	return a, nil
+}
+
+// fetchFirstJWKS returns the keys of the first of urls serving a JWKS
+func fetchFirstJWKS(urls []string, jwksConfig JWKSConfig, client *http.Client, status *jwksRefreshStatus, rotation *keyRotation, logger Logger) (*keySource, error) {
+	var err error
+	for _, url := range urls {
+		jwks, fetchErr := getJWKeyFunc(true, url, jwksConfig, client, status, rotation, logger)
+		if fetchErr != nil {
+			logger.Warnf("Could not fetch JWKS from %s, trying next JWKS URL: %v", url, fetchErr)
+			err = fetchErr
+			continue
+		}
+		return &keySource{
+			jwks:    jwks,
+			jwksURL: url,
+			keyFunc: asymmetricKeyfunc(jwks.Keyfunc),
+		}, nil
+	}
+	return nil, errors.Errorf("No JWKS URL could be fetched: %v", err)
+}
+
+// startJWKSFailover replaces the keys by those from the first of urls
+// serving a JWKS whenever a refresh failed, until Close. While another than
+// the first URL is in use, the URLs of higher priority are tried every
+// failbackInterval, and the keys replaced by those of the first serving a
+// JWKS. If no URL tried serves a JWKS, the last fetched keys are kept.
+func (a *KeycloakAuthenticator) startJWKSFailover(urls []string, failbackInterval time.Duration, refreshFailed <-chan struct{}, newKeySource func([]string) (*keySource, error)) {
+	a.runInBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(failbackInterval)
+		defer ticker.Stop()
+		for {
+			tried := urls
+			select {
+			case <-ctx.Done():
+				return
+			case <-refreshFailed:
+			case <-ticker.C:
+				tried = urls[:jwksURLPriority(urls, a.keys.Load().jwksURL)]
+				if len(tried) == 0 { // the first URL is in use
+					continue
+				}
+			}
+
+			keys, err := newKeySource(tried)
+			if err != nil {
+				if len(tried) < len(urls) {
+					a.logger.Warnf("JWKS failback failed, keeping JWKS URL %s: %v", a.keys.Load().jwksURL, err)
+				} else {
+					a.logger.Errorf("JWKS failover failed, keeping last fetched keys: %v", err)
+				}
+				continue
+			}
+			if ctx.Err() != nil { // closed during the fetch
+				keys.jwks.EndBackground()
+				return
+			}
+			current := a.keys.Load()
+			a.keys.Store(keys)
+			current.jwks.EndBackground()
+			if keys.jwksURL != current.jwksURL {
+				a.logger.Warnf("JWKS URL changed from %s to %s", current.jwksURL, keys.jwksURL)
+			}
+		}
+	})
+}
+
+// jwksURLPriority returns the index of url in urls, len(urls) if missing
+func jwksURLPriority(urls []string, url string) int {
+	for i, candidate := range urls {
+		if candidate == url {
+			return i
+		}
+	}
+	return len(urls)
+}
@@ -0,0 +1,74 @@
+package authenticator
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// JWTSVIDConfig holds the options for a JWTSVIDAuthenticator
+type JWTSVIDConfig struct {
+	// Bundles provides the JWT authorities of the trusted trust domains
+	Bundles jwtbundle.Source
+	// Audiences lists accepted aud values, at least one is required
+	Audiences []string
+	// RoleMappings grants roles by SPIFFE ID; the roles of all matching
+	// mappings are combined
+	RoleMappings []SPIFFEIDRoleMapping
+}
+
+// JWTSVIDAuthenticator authenticates workloads presenting a SPIFFE JWT-SVID
+// as bearer token, so that they can call the Tornjak API with the identity
+// issued to them by SPIRE.
+type JWTSVIDAuthenticator struct {
+	bundles      jwtbundle.Source
+	audiences    []string
+	roleMappings []SPIFFEIDRoleMapping
+}
+
+func NewJWTSVIDAuthenticator(config JWTSVIDConfig) (*JWTSVIDAuthenticator, error) {
+	if config.Bundles == nil {
+		return nil, errors.New("A JWT bundle source is required")
+	}
+	if len(config.Audiences) == 0 {
+		return nil, errors.New("At least one audience is required")
+	}
+	if err := validateSPIFFEIDPatterns(config.RoleMappings); err != nil {
+		return nil, err
+	}
+	return &JWTSVIDAuthenticator{
+		bundles:      config.Bundles,
+		audiences:    config.Audiences,
+		roleMappings: config.RoleMappings,
+	}, nil
+}
+
+func (a *JWTSVIDAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	token, err := getToken(r, "", "", nil)
+	if err != nil {
+		return wrapAuthenticationError(err)
+	}
+
+	svid, err := jwtsvid.ParseAndValidate(token, a.bundles, a.audiences)
+	if err != nil {
+		return wrapAuthenticationError(newAuthError(ErrInvalidToken, err, "Error validating JWT-SVID: %v", err))
+	}
+
+	roles := spiffeIDRoles(a.roleMappings, svid.ID.String())
+	if len(roles) == 0 {
+		return wrapAuthenticationError(newAuthError(ErrInsufficientRoles, nil, "SPIFFE ID %s has no Tornjak role mapping", svid.ID))
+	}
+	return &user.UserInfo{
+		Roles:     roles,
+		Subject:   svid.ID.String(),
+		ExpiresAt: svid.Expiry,
+	}
+}
+
+func (a *JWTSVIDAuthenticator) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package authenticator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyRotation detects changes of the key set across JWKS fetches
+type keyRotation struct {
+	mu     sync.Mutex
+	keySet string // fingerprint of the last fetched key set, empty before the first fetch
+	// rotated holds one pending notification, further changes are coalesced
+	rotated chan struct{}
+}
+
+func newKeyRotation() *keyRotation {
+	return &keyRotation{rotated: make(chan struct{}, 1)}
+}
+
+// observe records the key set of a fetched JWKS and signals rotated if it
+// differs from the previously fetched one. It never blocks.
+func (r *keyRotation) observe(raw []byte) {
+	if r == nil {
+		return
+	}
+	keySet := keySetFingerprint(raw)
+	if keySet == "" { // unparsable, reported by the JWKS parser
+		return
+	}
+	r.mu.Lock()
+	previous := r.keySet
+	r.keySet = keySet
+	r.mu.Unlock()
+	if previous == "" || previous == keySet {
+		return
+	}
+	select {
+	case r.rotated <- struct{}{}:
+	default:
+	}
+}
+
+// keySetFingerprint returns the compacted keys of a JWKS in sorted order,
+// so that reordering or reformatting the keys is not seen as a change
+func keySetFingerprint(raw []byte) string {
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		return ""
+	}
+	keys := make([]string, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		compacted := &bytes.Buffer{}
+		if err := json.Compact(compacted, key); err != nil {
+			return ""
+		}
+		keys = append(keys, compacted.String())
+	}
+	sort.Strings(keys)
+	return "[" + strings.Join(keys, ",") + "]"
+}
+
+// handleKeyRotation handles key set changes of the JWKS fetched with
+// config: in a goroutine if it is refreshed in the background, otherwise
+// in RefreshJWKS
+func (a *KeycloakAuthenticator) handleKeyRotation(config JWKSConfig) {
+	if config.refreshesInBackground() {
+		a.watchKeyRotation(config.OnKeyRotation)
+		return
+	}
+	a.syncKeyRotation = true
+	a.onKeyRotation = config.OnKeyRotation
+}
+
+// watchKeyRotation clears the token cache and calls onKeyRotation, if set,
+// whenever the key set changes, until Close. It runs in its own goroutine
+// so that a slow callback does not hold up JWKS refreshes.
+func (a *KeycloakAuthenticator) watchKeyRotation(onKeyRotation func()) {
+	a.runInBackground(func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.keyRotation.rotated:
+			}
+			a.keysRotated(onKeyRotation)
+		}
+	})
+}
+
+// keysRotated clears the token cache and calls onKeyRotation, if set
+func (a *KeycloakAuthenticator) keysRotated(onKeyRotation func()) {
+	a.logger.Warnf("JWKS key set changed, clearing token cache")
+	if a.tokenCache != nil {
+		a.tokenCache.clear()
+	}
+	if onKeyRotation != nil {
+		onKeyRotation()
+	}
+}
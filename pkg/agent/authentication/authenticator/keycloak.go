@@ -2,16 +2,23 @@ package authenticator
 
 import (
 	"context"
-	"fmt"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	keyfunc "github.com/MicahParks/keyfunc/v2"
 	jwt "github.com/golang-jwt/jwt/v5"
-	"github.com/pardot/oidc/discovery"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
 )
@@ -21,80 +28,890 @@ type RealmAccessSubclaim struct {
 }
 
 type KeycloakClaim struct {
-	RealmAccess RealmAccessSubclaim `json:"realm_access"`
+	RealmAccess       RealmAccessSubclaim            `json:"realm_access"`
+	ResourceAccess    map[string]RealmAccessSubclaim `json:"resource_access"`
+	Email             string                         `json:"email,omitempty"`
+	EmailVerified     bool                           `json:"email_verified,omitempty"`
+	PreferredUsername string                         `json:"preferred_username,omitempty"`
+	AuthorizedParty   string                         `json:"azp,omitempty"`
+	Scope             string                         `json:"scope,omitempty"`
 	jwt.RegisteredClaims
+
+	// all claims of the token, used to resolve configurable claim paths
+	raw map[string]interface{}
 }
 
-type KeycloakAuthenticator struct {
-	jwks     *keyfunc.JWKS
+// default claim path at which roles are found in the token
+const defaultRolesClaim = "realm_access.roles"
+
+// KeycloakConfig holds the options for a KeycloakAuthenticator
+type KeycloakConfig struct {
+	// IssuerURL is used for OIDC discovery
+	IssuerURL string
+	// Issuer is the expected iss claim of tokens, defaults to IssuerURL;
+	// empty skips the issuer check
+	Issuer string
+	// HTTPClient is used for OIDC discovery and fetching the JWKS,
+	// defaults to a client keeping connections alive as configured by
+	// Transport
+	HTTPClient *http.Client
+	// TLS configures the client used for OIDC discovery and fetching the
+	// JWKS; it cannot be combined with HTTPClient
+	TLS TLSConfig
+	// Transport tunes the connections of the client used for OIDC
+	// discovery and fetching the JWKS; it cannot be combined with
+	// HTTPClient
+	Transport TransportConfig
+	// AllowInsecure permits http:// issuer and JWKS URLs, for local testing
+	// only; by default they must use https
+	AllowInsecure bool
+	// DiscoveryRefreshInterval, if set, is how often OIDC discovery is
+	// repeated to pick up a changed JWKS URI
+	DiscoveryRefreshInterval time.Duration
+	// DiscoveryRetry configures retries of OIDC discovery at construction
+	DiscoveryRetry DiscoveryRetryConfig
+	// DiscoveryCacheFile, if set, is the file the provider metadata of
+	// every successful OIDC discovery is saved to. If discovery fails at
+	// construction, the saved metadata is used instead, provided it is no
+	// older than DiscoveryCacheMaxAge, defaulting to 24 hours, and
+	// discovery is retried in the background until it succeeds. The JWKS
+	// failing to load then as well is tolerated; tokens are rejected until
+	// it is fetched.
+	DiscoveryCacheFile   string
+	DiscoveryCacheMaxAge time.Duration
+	// Audiences lists accepted aud values; empty skips the audience check
+	Audiences []string
+	// EnforceAudience, if set to false, accepts tokens whatever their aud
+	// claim while keeping every other check, for a phased rollout until
+	// all clients obtain tokens for Audiences. Defaults to true; disabling
+	// it is warned about at construction.
+	EnforceAudience *bool
+	// AuthorizedParty, if set, is the required azp claim of tokens, i.e.
+	// the client the token was issued to
+	AuthorizedParty string
+	// RequiredTokenType, if set, is the required typ header of tokens, e.g.
+	// at+jwt to only accept access tokens as defined by RFC 9068. It is
+	// compared case-insensitively, with or without the application/ prefix.
+	RequiredTokenType string
+	// DecryptionKey, if set, decrypts JWE tokens, encrypted with RSA-OAEP
+	// or RSA-OAEP-256 and A256GCM, to the signed JWT they wrap, which is
+	// then validated as usual
+	DecryptionKey *rsa.PrivateKey
+	// RequireEncryption rejects tokens that are not JWE-encrypted; it
+	// requires DecryptionKey
+	RequireEncryption bool
+	// RequireEmailVerified rejects tokens whose email_verified claim is
+	// false or absent with ErrEmailNotVerified
+	RequireEmailVerified bool
+	// JWKS configures background refresh of the JWKS
+	JWKS JWKSConfig
+	// RoleMappings maps token roles to Tornjak roles; nil passes roles through
+	// unless RolePatternMappings is set
+	RoleMappings map[string]string
+	// RolePrefix, if set, is stripped from token roles before they are
+	// translated; token roles without it are ignored
+	RolePrefix string
+	// CompositeRoles expands a token role into several roles, replacing it
+	// before RoleMappings and RolePatternMappings are applied
+	CompositeRoles map[string][]string
+	// ScopeMappings maps the space separated OAuth scopes of the scope
+	// claim to Tornjak roles, added to those translated from token roles;
+	// scopes without a mapping are ignored
+	ScopeMappings map[string]string
+	// RolePatternMappings maps token roles without an exact mapping, trying
+	// the patterns in order
+	RolePatternMappings []RolePatternMapping
+	// GroupMappings maps the groups at GroupsClaim, Keycloak group paths
+	// such as /platform/tornjak/admins, to Tornjak roles, added to those
+	// translated from token roles; groups without a mapping are ignored.
+	// GroupsClaim is a dot separated path, defaulting to "groups".
+	GroupMappings []GroupMapping
+	GroupsClaim   string
+	// RequireMappedRole rejects tokens with ErrInsufficientRoles when
+	// none of their roles translates to a Tornjak role
+	RequireMappedRole bool
+	// RolesClaim is the dot separated path to the roles in the token,
+	// defaults to "realm_access.roles"
+	RolesClaim string
+	// RolesClientID, if set, adds the client roles found in
+	// resource_access.<RolesClientID>.roles to the roles from RolesClaim
+	RolesClientID string
+	// Leeway is the clock skew tolerated when checking the exp, nbf, iat
+	// and MaxTokenAge; defaults to zero, i.e. no tolerance
+	Leeway time.Duration
+	// MaxTokenAge, if set, rejects tokens issued longer ago than this and
+	// tokens without an iat claim
+	MaxTokenAge time.Duration
+	// SingleUseRoles, if set, makes tokens granting any of these Tornjak
+	// roles single use: they must carry a jti claim, and a jti already
+	// seen is rejected until the token expires. Such tokens are not cached.
+	SingleUseRoles []string
+	// MinRemainingTTL, if set, rejects tokens expiring within this window
+	// with ErrTokenExpiresSoon, so that clients refresh them before
+	// starting a long-running operation
+	MinRemainingTTL time.Duration
+	// TokenCookieName, if set, is the cookie read for the token when
+	// the Authorization header is missing
+	TokenCookieName string
+	// TokenFormField, if set, is the field of a posted URL encoded or
+	// multipart form read for the token when neither the Authorization
+	// header nor the cookie hold one, for browser form submissions such as
+	// file uploads that cannot set the header
+	TokenFormField string
+	// TokenQueryParameter, if set, is the query parameter read for the token
+	// as a last resort, for GET and HEAD requests to TokenQueryPaths only,
+	// such as download links opened by a browser. Query parameters leak
+	// into access logs and browser history: only enable it for a few
+	// download endpoints, with short-lived tokens.
+	TokenQueryParameter string
+	// TokenQueryPaths lists the patterns, as understood by path.Match, of
+	// the paths TokenQueryParameter is read for, e.g. "/api/v1/export/*";
+	// required with TokenQueryParameter
+	TokenQueryPaths []string
+	// TokenHeader is the header read for the token, defaults to
+	// Authorization. Another header, such as X-Forwarded-Access-Token set
+	// by an authenticating proxy, may hold the raw token without a scheme.
+	TokenHeader string
+	// TokenSchemes lists the schemes accepted in the Authorization header,
+	// e.g. "Token" for clients that cannot send Bearer. They are matched
+	// case-insensitively; defaults to Bearer only.
+	TokenSchemes []string
+	// Login, if set, enables the browser login flow served by
+	// LoginHandlers, which stores the token in TokenCookieName. It is only
+	// supported with OIDC discovery, i.e. by NewKeycloakAuthenticator.
+	Login *LoginConfig
+	// Logger receives diagnostic output, defaults to stdout
+	Logger Logger
+	// Metrics, if set, records authentication outcomes
+	Metrics *Metrics
+	// AuditSink, if set, receives every authentication decision, e.g. for
+	// compliance; see NewJSONAuditSink and OpenJSONAuditLog. It is closed
+	// by Close if it is an io.Closer, but left open if the construction of
+	// the authenticator fails.
+	AuditSink AuditSink
+	// TracerProvider provides the tracer of authentication spans,
+	// defaults to the global OpenTelemetry provider
+	TracerProvider trace.TracerProvider
+	// DisableTokenCache turns off caching of validated tokens until they expire
+	DisableTokenCache bool
+	// RoleCacheTTL, if set, caches the Tornjak roles resolved for a sub
+	// claim for this long, so that new tokens of the same user with the same
+	// roles, scopes and groups reuse them.
+	// Role changes at the IAM System then only apply once the TTL passed,
+	// or after logout or a change of the role mappings.
+	RoleCacheTTL time.Duration
+	// UserInfoRoles adds the roles found in the response of the userinfo
+	// endpoint of the issuer, like those of tokens, to the token roles, for
+	// issuers keeping tokens lean. It requires OIDC discovery. Responses are
+	// cached per subject for UserInfoCacheTTL, defaulting to 5 minutes.
+	UserInfoRoles    bool
+	UserInfoCacheTTL time.Duration
+	// TokenExchange, if set, enables ExchangeToken; it requires OIDC
+	// discovery
+	TokenExchange *TokenExchangeConfig
+	// TenantClaim, if set, is the dot separated path of the claim naming the
+	// tenant of the token, e.g. "tenant". Tokens must then carry one of
+	// the tenants of TenantRoleMappings.
+	TenantClaim string
+	// TenantRoleMappings maps each served tenant to the role mappings of
+	// its tokens, which take precedence over RoleMappings
+	TenantRoleMappings map[string]map[string]string
+	// AllowedNetworks, if set, lists the CIDRs requests must originate
+	// from, on top of carrying a valid token; others are rejected with
+	// ErrUntrustedNetwork. Tokens passed to AuthenticateToken, without a
+	// request, are not checked.
+	AllowedNetworks []string
+	// NetworkRestrictedRoles limits the AllowedNetworks check to users
+	// holding one of these Tornjak roles, e.g. admin; empty checks all users
+	NetworkRestrictedRoles []string
+	// TrustedProxyHops is the number of proxies in front of the server
+	// appending the client address to X-Forwarded-For. Zero uses the
+	// remote address of the connection and ignores X-Forwarded-For.
+	TrustedProxyHops int
+	// Enrich, if set, is called with the claims of every valid token and
+	// the UserInfo built from them, to set Attributes or adjust roles. It
+	// runs once the roles were translated to Tornjak roles, so roles it
+	// sets are used as they are; RequireMappedRole and the single-use and
+	// role checks apply to the result. The UserInfo is cached with the
+	// token, so Enrich must only depend on the claims. It must be safe for
+	// concurrent use.
+	Enrich func(claims *KeycloakClaim, u *user.UserInfo)
+	// AllowedAlgorithms lists the accepted signing algorithms, such as
+	// ES256, ES384 or EdDSA for ECDSA and Ed25519 keys; defaults to RS256,
+	// or HS256 when validating with an HMAC secret
+	AllowedAlgorithms []string
+	// AllowedKIDs, if set, lists the only key IDs trusted: tokens whose kid
+	// header is not listed are rejected, even if the key source holds a
+	// matching key, e.g. one newly advertised by the JWKS endpoint
+	AllowedKIDs []string
+	// HostAudiences, if set, maps the hosts requests are for, as given by
+	// their Host header without port, to the audience expected of their
+	// tokens instead of Audiences, for one authenticator serving several
+	// frontends. Requests for other hosts are rejected. Tokens passed to
+	// AuthenticateToken, without a request, are checked against Audiences.
+	HostAudiences map[string]string
+	// ExposeClaims sets UserInfo.Claims to the full claim set of valid
+	// tokens, for handlers needing claims UserInfo does not model. It is
+	// off by default so that claims are only handed out where needed.
+	ExposeClaims bool
+}
+
+// keySource holds the keys tokens are verified with. It is replaced as a
+// whole when rediscovery finds a new JWKS URI.
+type keySource struct {
+	metadata *providerMetadata // nil when tokens are verified with an HMAC secret
+	jwks     *keyfunc.JWKS     // nil when tokens are verified with an HMAC secret
 	jwksURL  string
-	audience string
+	keyFunc  jwt.Keyfunc
+}
+
+// validationParams are the expected issuer and audiences of tokens, replaced
+// together so that each token is validated against a consistent pair
+type validationParams struct {
+	issuer    string
+	audiences []string
+	// generation counts the replacements, so that validations against
+	// replaced params are neither shared with nor cached for later ones
+	generation uint64
+}
+
+type KeycloakAuthenticator struct {
+	keys          atomic.Pointer[keySource]
+	allowedAlgs   []string
+	params        atomic.Pointer[validationParams]
+	azp           string
+	roleMappings  atomic.Pointer[map[string]string]
+	scopeMappings map[string]string
+	composites    map[string][]string
+	rolePrefix    string
+	rolePatterns  []RolePatternMapping
+	requireRole   bool
+	rolesClaim    string
+	rolesClientID string
+	leeway        time.Duration
+	maxTokenAge   time.Duration
+	minTTL        time.Duration
+	cookieName    string
+	tokenHeader   string
+	tokenSchemes  []string
+	tokenCache    *tokenCache
+	roleCache     *roleCache // nil unless a role cache TTL is configured
+	enrich        func(claims *KeycloakClaim, u *user.UserInfo)
+	userInfoCache *roleCache // roles from the userinfo endpoint, nil unless enabled
+	validations   singleflight.Group
+	// replayCache is nil unless singleUseRoles are configured
+	replayCache    *replayCache
+	singleUseRoles []string
+	refreshStatus  *jwksRefreshStatus
+	keyRotation    *keyRotation // nil if keys are not refreshed
+	login          *login       // nil if no login is configured
+	httpClient     *http.Client // client of the login flow, nil for http.DefaultClient
+	metrics        *Metrics
+	logger         Logger
+	tracer         trace.Tracer
+	unmappedRoles  unmappedRoleSet
+
+	networks *networkAllowlist // nil unless allowed networks are configured
+
+	auditSink AuditSink // nil unless auditing is configured
+
+	formField  string // form field holding the token, empty if not read
+	tokenQuery tokenQuery
+
+	// enforceAudience is unset if tokens not matching audiences are only
+	// logged, during a migration
+	enforceAudience bool
+
+	groupsClaim   string
+	groupMappings []GroupMapping
+
+	tokenType string // normalized required typ header, empty if not checked
+
+	decrypter *tokenDecrypter // nil unless tokens are decrypted
+
+	exchanger *tokenExchanger // nil unless token exchange is configured
+
+	requireEmailVerified bool
+
+	allowedKIDs map[string]struct{} // nil if all keys are trusted
+
+	// hostAudiences maps normalized hosts to their audience, nil unless
+	// the audience depends on the host of requests
+	hostAudiences map[string]string
+
+	exposeClaims bool
+
+	// now is the clock tokens are validated against, time.Now except in tests
+	now func() time.Time
+
+	// tenants served, empty unless a tenant claim is configured
+	tenantClaim        string
+	tenantRoleMappings map[string]map[string]string
+
+	// syncKeyRotation is set if key set changes are handled by RefreshJWKS,
+	// calling onKeyRotation, as no background goroutine refreshes the JWKS
+	syncKeyRotation bool
+	onKeyRotation   func()
+
+	// context of background goroutines, such as periodic rediscovery,
+	// canceled by Close; nil if none runs
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
 }
 
-func getJWKeyFunc(httpjwks bool, jwksInfo string) (*keyfunc.JWKS, error) {
+// defaults for JWKS refresh, used when not set in JWKSConfig
+const (
+	defaultJWKSRefreshInterval  = time.Hour
+	defaultJWKSRefreshRateLimit = time.Minute * 5
+	defaultJWKSRefreshTimeout   = time.Second * 10
+)
+
+// JWKSConfig configures background refresh of the JWKS
+// zero values fall back to the defaults above
+type JWKSConfig struct {
+	RefreshInterval   time.Duration
+	RefreshRateLimit  time.Duration
+	RefreshTimeout    time.Duration
+	RefreshUnknownKID *bool
+	// RefreshErrorHandler is called with each background refresh error,
+	// and defaults to logging the error
+	RefreshErrorHandler func(error)
+	// UnhealthyAfter is how long refreshes must keep failing before
+	// Healthy reports an error; zero reports the first failure
+	UnhealthyAfter time.Duration
+	// OnKeyRotation is called whenever a refresh changes the key set,
+	// after the token cache was cleared. It is called from a separate
+	// goroutine and must not block for long.
+	OnKeyRotation func()
+	// DisableRefresh fetches the JWKS once and refreshes it only when
+	// RefreshJWKS is called, for short-lived processes. Unknown key IDs
+	// then only trigger a refresh if RefreshUnknownKID is set explicitly,
+	// otherwise no background goroutine runs.
+	DisableRefresh bool
+	// RespectCacheHeaders refreshes the JWKS when the Cache-Control max-age
+	// or Expires of the last response says, bounded by RefreshRateLimit and
+	// a day, instead of every RefreshInterval, which applies to responses
+	// without those headers
+	RespectCacheHeaders bool
+	// RetryInitialInterval enables retries of failed refreshes with
+	// exponential backoff, starting after this interval, so that replicas
+	// spread their retries while the IAM System recovers. Zero leaves
+	// failures to the next regular refresh.
+	RetryInitialInterval time.Duration
+	// RetryMaxInterval caps the backoff between retries, defaults to 5m
+	RetryMaxInterval time.Duration
+	// RetryJitter randomizes each backoff by up to this fraction, between
+	// 0 and 1, defaults to 0.5
+	RetryJitter float64
+	// AllowEmpty lets construction succeed if the JWKS holds no usable
+	// keys, starting degraded: tokens are rejected and Healthy reports an
+	// error until a refresh finds keys. By default construction fails.
+	AllowEmpty bool
+
+	// tolerateFetchError lets construction succeed, with no keys, if the
+	// JWKS cannot be fetched, when starting on cached provider metadata
+	tolerateFetchError bool
+}
+
+// refreshesInBackground reports whether the JWKS is refreshed by a
+// background goroutine, on a timer or for unknown key IDs
+func (c JWKSConfig) refreshesInBackground() bool {
+	return !c.DisableRefresh || c.RefreshUnknownKID != nil && *c.RefreshUnknownKID
+}
+
+func (c JWKSConfig) keyfuncOptions(client *http.Client, status *jwksRefreshStatus, rotation *keyRotation, logger Logger) keyfunc.Options {
+	opts := keyfunc.Options{
+		Client: client,
+		RefreshErrorHandler: func(err error) {
+			status.failed(err)
+			if c.RefreshErrorHandler != nil {
+				c.RefreshErrorHandler(err)
+				return
+			}
+			logger.Errorf("error with jwt.Keyfunc: %v", err)
+		},
+		ResponseExtractor: func(ctx context.Context, resp *http.Response) (json.RawMessage, error) {
+			raw, err := status.responseExtractor(ctx, resp)
+			if err == nil {
+				rotation.observe(raw)
+			}
+			return raw, err
+		},
+		RefreshInterval:   c.RefreshInterval,
+		RefreshRateLimit:  c.RefreshRateLimit,
+		RefreshTimeout:    c.RefreshTimeout,
+		RefreshUnknownKID: true,
+
+		TolerateInitialJWKHTTPError: c.tolerateFetchError,
+	}
+	if c.DisableRefresh {
+		opts.RefreshInterval = 0
+		opts.RefreshUnknownKID = false
+	} else if c.RespectCacheHeaders {
+		// refreshed by refreshOnCacheHeaders instead
+		opts.RefreshInterval = 0
+	} else if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = defaultJWKSRefreshInterval
+	}
+	if opts.RefreshRateLimit == 0 {
+		opts.RefreshRateLimit = defaultJWKSRefreshRateLimit
+	}
+	if opts.RefreshTimeout == 0 {
+		opts.RefreshTimeout = defaultJWKSRefreshTimeout
+	}
+	if c.RefreshUnknownKID != nil {
+		opts.RefreshUnknownKID = *c.RefreshUnknownKID
+	}
+	return opts
+}
+
+func getJWKeyFunc(httpjwks bool, jwksInfo string, jwksConfig JWKSConfig, client *http.Client, status *jwksRefreshStatus, rotation *keyRotation, logger Logger) (*keyfunc.JWKS, error) {
 	if httpjwks {
-		opts := keyfunc.Options{ // TODO add options to config file
-			RefreshErrorHandler: func(err error) {
-				fmt.Fprintf(os.Stdout, "error with jwt.Keyfunc: %v", err)
-			},
-			RefreshInterval:   time.Hour,
-			RefreshRateLimit:  time.Minute * 5,
-			RefreshTimeout:    time.Second * 10,
-			RefreshUnknownKID: true,
-		}
-		jwks, err := keyfunc.Get(jwksInfo, opts)
+		jwks, err := keyfunc.Get(jwksInfo, jwksConfig.keyfuncOptions(client, status, rotation, logger))
 		if err != nil {
 			return nil, errors.Errorf("Could not create Keyfunc for url %s: %v", jwksInfo, err)
 		}
+		// with a tolerated fetch error, the keys are fetched later
+		if jwks.Len() == 0 && !jwksConfig.tolerateFetchError {
+			if !jwksConfig.AllowEmpty {
+				jwks.EndBackground()
+				return nil, errors.Errorf("JWKS fetched from %s has no usable keys, check the signing keys configured at the IAM System", jwksInfo)
+			}
+			logger.Warnf("JWKS fetched from %s has no usable keys: tokens are rejected until a refresh finds keys", jwksInfo)
+		}
 		return jwks, nil
 	} else {
 		jwks, err := keyfunc.NewJSON([]byte(jwksInfo))
 		if err != nil {
 			return nil, errors.Errorf("Could not create Keyfunc for json %s: %v", jwksInfo, err)
 		}
+		if jwks.Len() == 0 && !jwksConfig.AllowEmpty {
+			return nil, errors.New("JWKS has no usable keys")
+		}
 		return jwks, nil
 	}
 }
 
-// newKeycloakAuthenticator (https bool, jwks string, redirect string)
-//
-//	get keyfunc based on https
-func NewKeycloakAuthenticator(httpjwks bool, issuerURL string, audience string) (*KeycloakAuthenticator, error) {
-	// perform OIDC discovery
-	oidcClient, err := discovery.NewClient(context.Background(), issuerURL)
+// NewKeycloakAuthenticator returns an authenticator verifying tokens with
+// the JWKS found by OIDC discovery of config.IssuerURL. If httpjwks is set
+// the JWKS is fetched from the discovered jwks_uri, otherwise jwks_uri is
+// parsed as the JWKS itself. ctx bounds the discovery performed here.
+func NewKeycloakAuthenticator(ctx context.Context, httpjwks bool, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, false)
 	if err != nil {
-		return nil, errors.Errorf("Could not set up OIDC Discovery client with issuer = '%s': %v", issuerURL, err)
+		return nil, err
+	}
+	if err := config.validate(true); err != nil {
+		return nil, err
+	}
+	client, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	logger := loggerOrDefault(config.Logger)
+
+	// perform OIDC discovery, saving the metadata found if a cache file is
+	// configured, or falling back to the saved metadata
+	discover := func(ctx context.Context) (*providerMetadata, error) {
+		metadata, err := discoverMetadata(ctx, client, config.IssuerURL)
+		if err == nil && config.DiscoveryCacheFile != "" {
+			if err := saveCachedMetadata(config.DiscoveryCacheFile, config.IssuerURL, metadata); err != nil {
+				logger.Warnf("%v", err)
+			}
+		}
+		return metadata, err
+	}
+	oidcClientMetadata, err := discoverMetadataWithRetry(ctx, discover, config.IssuerURL, config.DiscoveryRetry, logger)
+	fromCache := false
+	if err != nil {
+		if config.DiscoveryCacheFile == "" {
+			return nil, errors.Errorf("Could not perform OIDC Discovery with issuer = '%s': %v", config.IssuerURL, err)
+		}
+		cached, cacheErr := loadCachedMetadata(config.DiscoveryCacheFile, config.IssuerURL, config.discoveryCacheMaxAge())
+		if cacheErr != nil {
+			return nil, errors.Errorf("Could not perform OIDC Discovery with issuer = '%s': %v; %v", config.IssuerURL, err, cacheErr)
+		}
+		logger.Warnf("OIDC discovery with issuer = '%s' failed, using provider metadata cached in %s: %v", config.IssuerURL, config.DiscoveryCacheFile, err)
+		oidcClientMetadata = cached
+		fromCache = true
 	}
-	oidcClientMetadata := oidcClient.Metadata()
-	jwksURL := oidcClientMetadata.JWKSURI
 
 	// watch JWKS
-	jwks, err := getJWKeyFunc(httpjwks, jwksURL)
+	refreshStatus := newJWKSRefreshStatus(config.JWKS.UnhealthyAfter)
+	rotation := newKeyRotation()
+	loadKeySource := func(metadata *providerMetadata, jwksConfig JWKSConfig) (*keySource, error) {
+		jwks, err := getJWKeyFunc(httpjwks, metadata.JWKSURI, jwksConfig, client, refreshStatus, rotation, logger)
+		if err != nil {
+			return nil, err
+		}
+		return &keySource{
+			metadata: metadata,
+			jwks:     jwks,
+			jwksURL:  metadata.JWKSURI,
+			keyFunc:  asymmetricKeyfunc(jwks.Keyfunc),
+		}, nil
+	}
+	newKeySource := func(metadata *providerMetadata) (*keySource, error) {
+		return loadKeySource(metadata, config.JWKS)
+	}
+	// the issuer being down, the JWKS is fetched once discovery succeeds
+	initialJWKS := config.JWKS
+	initialJWKS.tolerateFetchError = fromCache
+	keys, err := loadKeySource(oidcClientMetadata, initialJWKS)
 	if err != nil {
 		return nil, err
 	}
-	return &KeycloakAuthenticator{
-		jwks:     jwks,
-		audience: audience,
-		jwksURL:  jwksURL,
-	}, nil
+
+	a := newKeycloakAuthenticator(keys, allowedAlgs, config)
+	a.refreshStatus = refreshStatus
+	a.keyRotation = rotation
+	a.httpClient = client
+	if config.UserInfoRoles {
+		if oidcClientMetadata.UserinfoEndpoint == "" {
+			a.abort()
+			return nil, errors.Errorf("Issuer '%s' has no userinfo endpoint to fetch roles from", config.IssuerURL)
+		}
+		ttl := config.UserInfoCacheTTL
+		if ttl == 0 {
+			ttl = defaultUserInfoCacheTTL
+		}
+		a.userInfoCache = newRoleCache(ttl)
+	}
+	if config.Login != nil {
+		if oidcClientMetadata.AuthorizationEndpoint == "" || oidcClientMetadata.TokenEndpoint == "" {
+			a.abort()
+			return nil, errors.Errorf("Issuer '%s' does not support the authorization code flow required for login", config.IssuerURL)
+		}
+		a.login, err = newLogin(*config.Login, config.TokenCookieName)
+		if err != nil {
+			a.abort()
+			return nil, err
+		}
+	}
+	a.handleKeyRotation(config.JWKS)
+	a.scheduleJWKSRefreshes(config.JWKS)
+	if fromCache {
+		a.retryDiscovery(discover, newKeySource)
+	}
+	if config.DiscoveryRefreshInterval > 0 {
+		a.startRediscovery(config.DiscoveryRefreshInterval, discover, newKeySource)
+	}
+	return a, nil
 }
 
-func getToken(r *http.Request, redirectURL string) (string, error) {
-	// Authorization parameter from HTTP header
-	auth_header := r.Header.Get("Authorization")
-	if auth_header == "" {
-		return "", errors.Errorf("Authorization header missing. Please obtain access token here: %s", redirectURL)
+// NewKeycloakAuthenticatorWithJWKS returns an authenticator verifying tokens
+// with the JWKS served at jwksURL. No OIDC discovery is performed, so that
+// issuers without a discovery document are supported; tokens are checked
+// against config.Issuer, or config.IssuerURL, if set. The JWKS is refreshed
+// in the background as configured by config.JWKS.
+func NewKeycloakAuthenticatorWithJWKS(jwksURL string, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false, jwksURL); err != nil {
+		return nil, err
 	}
+	client, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	logger := loggerOrDefault(config.Logger)
 
-	// get bearer token
-	auth_fields := strings.Fields(auth_header)
-	if len(auth_fields) != 2 || auth_fields[0] != "Bearer" {
-		return "", errors.Errorf("Expected bearer token, got %s", auth_header)
-	} else {
-		return auth_fields[1], nil
+	refreshStatus := newJWKSRefreshStatus(config.JWKS.UnhealthyAfter)
+	rotation := newKeyRotation()
+	jwks, err := getJWKeyFunc(true, jwksURL, config.JWKS, client, refreshStatus, rotation, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newKeycloakAuthenticator(&keySource{
+		jwks:    jwks,
+		jwksURL: jwksURL,
+		keyFunc: asymmetricKeyfunc(jwks.Keyfunc),
+	}, allowedAlgs, config)
+	a.refreshStatus = refreshStatus
+	a.keyRotation = rotation
+	a.handleKeyRotation(config.JWKS)
+	a.scheduleJWKSRefreshes(config.JWKS)
+	return a, nil
+}
+
+// NewKeycloakAuthenticatorWithHMAC returns an authenticator validating HS256
+// tokens signed with the given shared secret. No OIDC discovery is performed.
+func NewKeycloakAuthenticatorWithHMAC(secret []byte, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("HMAC secret must not be empty")
+	}
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false); err != nil {
+		return nil, err
+	}
+	return newKeycloakAuthenticator(&keySource{keyFunc: hmacKeyfunc(secret)}, allowedAlgs, config), nil
+}
+
+func newKeycloakAuthenticator(keys *keySource, allowedAlgs []string, config KeycloakConfig) *KeycloakAuthenticator {
+	issuer := config.Issuer
+	if issuer == "" {
+		issuer = config.IssuerURL
+	}
+
+	rolesClaim := config.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = defaultRolesClaim
+	}
+
+	var cache *tokenCache
+	if !config.DisableTokenCache {
+		cache = newTokenCache()
+	}
+	var replays *replayCache
+	if len(config.SingleUseRoles) > 0 {
+		replays = newReplayCache()
+	}
+	var roles *roleCache
+	if config.RoleCacheTTL > 0 {
+		roles = newRoleCache(config.RoleCacheTTL)
+	}
+
+	a := &KeycloakAuthenticator{
+		allowedAlgs:    allowedAlgs,
+		azp:            config.AuthorizedParty,
+		scopeMappings:  config.ScopeMappings,
+		composites:     config.CompositeRoles,
+		rolePrefix:     config.RolePrefix,
+		rolePatterns:   config.RolePatternMappings,
+		requireRole:    config.RequireMappedRole,
+		rolesClaim:     rolesClaim,
+		rolesClientID:  config.RolesClientID,
+		leeway:         config.Leeway,
+		maxTokenAge:    config.MaxTokenAge,
+		minTTL:         config.MinRemainingTTL,
+		cookieName:     config.TokenCookieName,
+		tokenHeader:    config.TokenHeader,
+		tokenSchemes:   config.TokenSchemes,
+		tokenCache:     cache,
+		roleCache:      roles,
+		enrich:         config.Enrich,
+		replayCache:    replays,
+		singleUseRoles: config.SingleUseRoles,
+		metrics:        config.Metrics,
+		logger:         loggerOrDefault(config.Logger),
+		tracer:         newTracer(config.TracerProvider),
+		now:            time.Now,
+	}
+	a.auditSink = config.AuditSink
+	a.formField = config.TokenFormField
+	a.tokenQuery = tokenQuery{parameter: config.TokenQueryParameter, paths: config.TokenQueryPaths}
+	a.groupMappings = config.GroupMappings
+	a.groupsClaim = config.GroupsClaim
+	if a.groupsClaim == "" {
+		a.groupsClaim = defaultGroupsClaim
+	}
+	a.tokenType = normalizeTokenType(config.RequiredTokenType)
+	a.decrypter = newTokenDecrypter(config)
+	a.exchanger = newTokenExchanger(config.TokenExchange)
+	a.requireEmailVerified = config.RequireEmailVerified
+	if len(config.HostAudiences) > 0 {
+		a.hostAudiences = make(map[string]string, len(config.HostAudiences))
+		for host, audience := range config.HostAudiences {
+			a.hostAudiences[normalizeHost(host)] = audience
+		}
+	}
+	a.exposeClaims = config.ExposeClaims
+	if len(config.AllowedKIDs) > 0 {
+		a.allowedKIDs = make(map[string]struct{}, len(config.AllowedKIDs))
+		for _, kid := range config.AllowedKIDs {
+			a.allowedKIDs[kid] = struct{}{}
+		}
+	}
+	a.enforceAudience = config.EnforceAudience == nil || *config.EnforceAudience
+	if !a.enforceAudience {
+		a.logger.Warnf("Audience validation is DISABLED: tokens are accepted whatever their aud claim. Enable it again once all clients obtain tokens for audiences %v", config.Audiences)
+	}
+	if len(config.AllowedNetworks) > 0 {
+		// networks are validated at construction
+		networks, _ := parseNetworks(config.AllowedNetworks)
+		a.networks = &networkAllowlist{
+			networks:       networks,
+			trustedProxies: config.TrustedProxyHops,
+			roles:          config.NetworkRestrictedRoles,
+		}
+	}
+	if config.TenantClaim != "" {
+		a.tenantClaim = config.TenantClaim
+		a.tenantRoleMappings = config.TenantRoleMappings
+	}
+	a.keys.Store(keys)
+	a.roleMappings.Store(&config.RoleMappings)
+	a.params.Store(&validationParams{issuer: issuer, audiences: config.Audiences})
+	return a
+}
+
+// Issuer returns the expected iss claim of tokens, empty if not checked
+func (a *KeycloakAuthenticator) Issuer() string {
+	return a.params.Load().issuer
+}
+
+// Audiences returns the accepted aud values of tokens, none if not checked
+func (a *KeycloakAuthenticator) Audiences() []string {
+	return append([]string{}, a.params.Load().audiences...)
+}
+
+// SetIssuer replaces the expected iss claim of tokens, empty skipping the
+// issuer check, keeping the keys and discovered metadata. It is safe to
+// call concurrently with request authentication: each token is validated
+// against either the old or the new issuer, along with the audiences set
+// at the time. Cached results are dropped so that the new issuer applies
+// to every following request.
+// An authenticator of a MultiIssuer keeps being selected for the issuer it
+// was created with.
+func (a *KeycloakAuthenticator) SetIssuer(issuer string) {
+	a.setParams(func(params *validationParams) { params.issuer = issuer })
+}
+
+// SetAudiences replaces the accepted aud values of tokens, none skipping
+// the audience check, like SetIssuer
+func (a *KeycloakAuthenticator) SetAudiences(audiences []string) {
+	audiences = append([]string{}, audiences...)
+	a.setParams(func(params *validationParams) { params.audiences = audiences })
+}
+
+// setParams stores a copy of the validation parameters updated by update
+func (a *KeycloakAuthenticator) setParams(update func(*validationParams)) {
+	for {
+		current := a.params.Load()
+		updated := *current
+		update(&updated)
+		updated.generation++
+		if a.params.CompareAndSwap(current, &updated) {
+			break
+		}
+	}
+	if a.tokenCache != nil {
+		a.tokenCache.clear()
+	}
+	if a.roleCache != nil {
+		a.roleCache.clear()
+	}
+}
+
+// keyFunc returns the keyfunc of keys, restricted to the allowed key IDs if
+// configured
+func (a *KeycloakAuthenticator) keyFunc(keys *keySource) jwt.Keyfunc {
+	keyFunc := keys.keyFunc
+	if a.allowedKIDs != nil {
+		return kidAllowlistKeyfunc(a.allowedKIDs, keyFunc)
+	}
+	return keyFunc
+}
+
+// parserOptions returns the options validating tokens of issuer. exp and
+// nbf are always checked when present; iat must not lie in the future.
+func (a *KeycloakAuthenticator) parserOptions(issuer string) []jwt.ParserOption {
+	return []jwt.ParserOption{
+		jwt.WithLeeway(a.leeway),
+		jwt.WithIssuedAt(),
+		jwt.WithValidMethods(a.allowedAlgs),
+		jwt.WithIssuer(issuer),
+		jwt.WithTimeFunc(a.now),
+	}
+}
+
+// setClock makes a validate tokens against now instead of the wall clock,
+// for tests to pin expiry, nbf and leeway scenarios. It must be called
+// before a is used.
+func (a *KeycloakAuthenticator) setClock(now func() time.Time) {
+	a.now = now
+	if a.tokenCache != nil {
+		a.tokenCache.now = now
 	}
+	if a.replayCache != nil {
+		a.replayCache.now = now
+	}
+}
 
+// verifyTokenAge checks that the token was issued within the maximum
+// token age. No check is done if none is configured.
+func (a *KeycloakAuthenticator) verifyTokenAge(claims *KeycloakClaim) error {
+	if a.maxTokenAge == 0 {
+		return nil
+	}
+	if claims.IssuedAt == nil {
+		return newAuthError(ErrInvalidToken, nil, "Token has no iat claim, required to check the maximum token age of %v", a.maxTokenAge)
+	}
+	if age := a.now().Sub(claims.IssuedAt.Time); age > a.maxTokenAge+a.leeway {
+		return newAuthError(ErrTokenExpired, nil, "Token was issued %v ago, exceeding the maximum token age of %v, please re-authenticate", age.Round(time.Second), a.maxTokenAge)
+	}
+	return nil
+}
+
+// verifyRemainingLifetime checks that the token does not expire within the
+// minimum remaining lifetime. Tokens without an exp claim never expire.
+func (a *KeycloakAuthenticator) verifyRemainingLifetime(claims *KeycloakClaim) error {
+	if a.minTTL == 0 || claims.ExpiresAt == nil {
+		return nil
+	}
+	if remaining := claims.ExpiresAt.Time.Sub(a.now()); remaining < a.minTTL {
+		return newAuthError(ErrTokenExpiresSoon, nil, "Token expires in %v, less than the required %v, please refresh it first", remaining.Round(time.Second), a.minTTL)
+	}
+	return nil
+}
+
+// verifyAudience checks that the token audience, a single string or an
+// array, matches at least one of the expected audiences. Empty values never
+// match. No check is done if none are configured.
+func (a *KeycloakAuthenticator) verifyAudience(claims *KeycloakClaim, audiences []string) error {
+	if len(audiences) == 0 {
+		return nil
+	}
+	for _, aud := range claims.Audience {
+		if aud == "" {
+			continue
+		}
+		for _, expected := range audiences {
+			if subtle.ConstantTimeCompare([]byte(aud), []byte(expected)) == 1 {
+				return nil
+			}
+		}
+	}
+	if !a.enforceAudience {
+		a.logger.Debugf("Accepting token audience %v not matching any expected audience %v, as audience validation is disabled", []string(claims.Audience), audiences)
+		return nil
+	}
+	return newAuthError(ErrInvalidToken, jwt.ErrTokenInvalidAudience, "Token audience %v does not match any expected audience %v", []string(claims.Audience), audiences)
+}
+
+// verifyAuthorizedParty checks that the token was issued to the expected
+// client. No check is done if none is configured.
+func (a *KeycloakAuthenticator) verifyAuthorizedParty(claims *KeycloakClaim) error {
+	if a.azp == "" || subtle.ConstantTimeCompare([]byte(claims.AuthorizedParty), []byte(a.azp)) == 1 {
+		return nil
+	}
+	return newAuthError(ErrInvalidToken, nil, "Token authorized party %q does not match expected authorized party %q", claims.AuthorizedParty, a.azp)
+}
+
+// verifyTokenType checks that the typ header of the token is the required
+// token type. No check is done if none is configured.
+func (a *KeycloakAuthenticator) verifyTokenType(token *jwt.Token) error {
+	if a.tokenType == "" {
+		return nil
+	}
+	typ, _ := token.Header["typ"].(string)
+	if normalizeTokenType(typ) != a.tokenType {
+		return newAuthError(ErrInvalidToken, ErrWrongTokenType, "Token type %q does not match required token type %q", typ, a.tokenType)
+	}
+	return nil
+}
+
+// normalizeTokenType returns the media type typ in lower case without the
+// application/ prefix, which RFC 7515 recommends omitting
+func normalizeTokenType(typ string) string {
+	return strings.TrimPrefix(strings.ToLower(typ), "application/")
 }
 
 func wrapAuthenticationError(err error) *user.UserInfo {
@@ -104,25 +921,291 @@ func wrapAuthenticationError(err error) *user.UserInfo {
 }
 
 func (a *KeycloakAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
-	token, err := getToken(r, a.jwksURL)
+	userInfo, _ := a.AuthenticateRequestContext(r.Context(), r)
+	return userInfo
+}
+
+// AuthenticateRequestContext authenticates r like AuthenticateRequest, with
+// the outbound calls of the validation, such as to the userinfo endpoint,
+// bound to ctx
+func (a *KeycloakAuthenticator) AuthenticateRequestContext(ctx context.Context, r *http.Request) (*user.UserInfo, error) {
+	userInfo := a.authenticateRequest(ctx, r)
+	return userInfo, userInfo.AuthenticationError
+}
+
+func (a *KeycloakAuthenticator) authenticateRequest(ctx context.Context, r *http.Request) *user.UserInfo {
+	ctx, span := a.tracer.Start(ctx, "KeycloakAuthenticator.AuthenticateRequest")
+	defer span.End()
+
+	token, err := a.getRequestToken(r)
 	if err != nil {
-		return wrapAuthenticationError(err)
+		a.metrics.observeAuthentication(err)
+		setSpanResult(span, err)
+		userInfo := wrapAuthenticationError(err)
+		a.audit(userInfo, r)
+		return userInfo
+	}
+	userInfo := a.authenticateToken(ctx, token, r)
+	setSpanResult(span, userInfo.AuthenticationError)
+	return userInfo
+}
+
+// AuthenticateToken validates a raw token and returns the UserInfo it grants.
+// It is the validation performed by AuthenticateRequest once the bearer token
+// is extracted, for callers that obtain the token some other way.
+func (a *KeycloakAuthenticator) AuthenticateToken(token string) *user.UserInfo {
+	return a.authenticateToken(context.Background(), token, nil)
+}
+
+// authenticateToken validates token, presented with r if not nil, in which
+// case the allowed networks are checked and the audience may depend on the
+// host
+func (a *KeycloakAuthenticator) authenticateToken(ctx context.Context, token string, r *http.Request) *user.UserInfo {
+	ctx, span := a.tracer.Start(ctx, "KeycloakAuthenticator.AuthenticateToken")
+	defer span.End()
+
+	start := time.Now()
+	var userInfo *user.UserInfo
+	if params, err := a.requestParams(r); err != nil {
+		userInfo = wrapAuthenticationError(err)
+	} else {
+		userInfo = a.validateCached(ctx, token, params, a.requestHost(r))
+	}
+	if userInfo.AuthenticationError == nil && a.networks != nil && r != nil {
+		if err := a.networks.check(r, userInfo); err != nil {
+			userInfo = wrapAuthenticationError(err)
+		}
+	}
+	a.metrics.observeValidation(time.Since(start))
+	a.metrics.observeAuthentication(userInfo.AuthenticationError)
+	a.audit(userInfo, r)
+
+	setSpanResult(span, userInfo.AuthenticationError)
+	span.SetAttributes(attribute.Int("tornjak.auth.roles", len(userInfo.Roles)))
+	return userInfo
+}
+
+// validateCached validates a token against params, answering from the
+// token cache if possible. Concurrent validations of a token are shared,
+// bound to the context of the first. host is the host the token was
+// presented for if the expected audience depends on it, empty otherwise.
+func (a *KeycloakAuthenticator) validateCached(ctx context.Context, token string, params *validationParams, host string) *user.UserInfo {
+	cacheKey := tokenCacheKey(token, host)
+	if a.tokenCache != nil {
+		if userInfo, ok := a.tokenCache.get(cacheKey); ok {
+			return userInfo
+		}
 	}
 
-	// parse token
+	// concurrent requests with the same token and params share a single
+	// validation
+	type validation struct {
+		userInfo *user.UserInfo
+		claims   *KeycloakClaim // nil if answered from the cache
+	}
+	key := sha256.Sum256([]byte(cacheKey))
+	flight := string(key[:]) + strconv.FormatUint(params.generation, 10)
+	result, _, _ := a.validations.Do(flight, func() (interface{}, error) {
+		// a validation finishing just before may have filled the cache
+		if a.tokenCache != nil {
+			if userInfo, ok := a.tokenCache.get(cacheKey); ok {
+				return validation{userInfo: userInfo}, nil
+			}
+		}
+
+		roleMappings := a.roleMappings.Load()
+		userInfo, claims := a.validateToken(ctx, token, params)
+
+		// cache successful validations, never past token expiry, age or
+		// remaining lifetime, nor when the role mappings or params were
+		// replaced or ctx ended during validation, which may have cut short
+		// fetching roles; single-use tokens are checked on every use
+		if a.tokenCache != nil && userInfo.AuthenticationError == nil && claims.ExpiresAt != nil && a.roleMappings.Load() == roleMappings && a.params.Load().generation == params.generation && ctx.Err() == nil && !a.singleUse(userInfo) {
+			expiry := claims.ExpiresAt.Time.Add(-a.minTTL)
+			if a.maxTokenAge != 0 {
+				if maxAge := claims.IssuedAt.Add(a.maxTokenAge + a.leeway); maxAge.Before(expiry) {
+					expiry = maxAge
+				}
+			}
+			a.tokenCache.put(cacheKey, userInfo, expiry)
+		}
+		return validation{userInfo: userInfo, claims: claims}, nil
+	})
+	v := result.(validation)
+
+	// each request sharing the validation uses the token once
+	if v.claims != nil {
+		if err := a.checkReplay(v.userInfo, v.claims); err != nil {
+			return wrapAuthenticationError(err)
+		}
+	}
+	return copyUserInfo(v.userInfo)
+}
+
+// validateToken parses and validates the token against params, returning
+// the resulting UserInfo along with the parsed claims
+func (a *KeycloakAuthenticator) validateToken(ctx context.Context, token string, params *validationParams) (*user.UserInfo, *KeycloakClaim) {
+	claims, tenant, tenantRoleMappings, err := a.verifyToken(token, params)
+	if err != nil {
+		return wrapAuthenticationError(err), claims
+	}
+
+	userInfo := &user.UserInfo{
+		Roles:             a.resolveRoles(ctx, token, claims, tenant, tenantRoleMappings),
+		Tenant:            tenant,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		PreferredUsername: claims.PreferredUsername,
+	}
+	if claims.ExpiresAt != nil {
+		userInfo.ExpiresAt = claims.ExpiresAt.Time
+	}
+	if a.exposeClaims {
+		userInfo.Claims = claims.Claims()
+	}
+	if a.enrich != nil {
+		a.enrich(claims, userInfo)
+	}
+	if a.requireRole && len(userInfo.Roles) == 0 {
+		return wrapAuthenticationError(newAuthError(ErrInsufficientRoles, nil, "Token has no roles mapping to a Tornjak role")), claims
+	}
+	return userInfo, claims
+}
+
+// verifyToken parses token and checks its signature and claims against
+// params, returning the claims, as far as parsed if invalid, along with the
+// tenant of the token and its role mappings
+func (a *KeycloakAuthenticator) verifyToken(token string, params *validationParams) (*KeycloakClaim, string, map[string]string, error) {
+	// decrypt and parse token
 	claims := &KeycloakClaim{}
-	parserOptions := jwt.WithAudience(a.audience)
-	jwt_token, err := jwt.ParseWithClaims(token, claims, a.jwks.Keyfunc, parserOptions)
+	token, err := a.decrypter.decrypt(token)
+	if err != nil {
+		return claims, "", nil, err
+	}
+	keys := a.keys.Load()
+	jwt_token, err := jwt.ParseWithClaims(token, claims, a.keyFunc(keys), a.parserOptions(params.issuer)...)
+	if err != nil && !algorithmAllowed(jwt_token, a.allowedAlgs) {
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token signing algorithm %v is not allowed, expected one of %v", jwt_token.Header["alg"], a.allowedAlgs)
+	}
+	if errors.Is(err, errKIDNotAllowed) {
+		if kid, _ := jwt_token.Header["kid"].(string); kid != "" {
+			return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token key ID %q is not one of the allowed key IDs", kid)
+		}
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token has no key ID, required to be one of the allowed key IDs")
+	}
+	if errors.Is(err, jwt.ErrTokenNotValidYet) {
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token is not valid yet, nbf is %v", claims.NotBefore)
+	}
+	if errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token is not valid yet, iat %v lies in the future", claims.IssuedAt)
+	}
+	if errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token issuer %q does not match expected issuer %q", claims.Issuer, params.issuer)
+	}
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return claims, "", nil, newAuthError(ErrTokenExpired, err, "Token expired at %v, please re-authenticate", claims.ExpiresAt)
+	}
+	if errors.Is(err, jwt.ErrTokenUnverifiable) && keys.jwks != nil && keys.jwks.Len() == 0 {
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Token cannot be verified, the JWKS has no usable keys")
+	}
 	if err != nil {
-		return wrapAuthenticationError(errors.Errorf("Error parsing token :%s", err.Error()))
+		return claims, "", nil, newAuthError(ErrInvalidToken, err, "Error parsing token :%s", err.Error())
 	}
 
 	// check token validity
 	if !jwt_token.Valid {
-		return wrapAuthenticationError(errors.New("Token invalid"))
+		return claims, "", nil, newAuthError(ErrInvalidToken, nil, "Token invalid")
 	}
 
-	return &user.UserInfo{
-		Roles: claims.RealmAccess.Roles,
+	// check token age and remaining lifetime
+	if err := a.verifyTokenAge(claims); err != nil {
+		return claims, "", nil, err
+	}
+	if err := a.verifyRemainingLifetime(claims); err != nil {
+		return claims, "", nil, err
+	}
+
+	// check token audience
+	if err := a.verifyAudience(claims, params.audiences); err != nil {
+		return claims, "", nil, err
+	}
+	if err := a.verifyAuthorizedParty(claims); err != nil {
+		return claims, "", nil, err
+	}
+	if err := a.verifyTokenType(jwt_token); err != nil {
+		return claims, "", nil, err
+	}
+	if a.requireEmailVerified && !claims.EmailVerified {
+		return claims, "", nil, newAuthError(ErrEmailNotVerified, nil, "Token email %q is not verified", claims.Email)
+	}
+
+	tenant, tenantRoleMappings, err := a.verifyTenant(claims)
+	if err != nil {
+		return claims, "", nil, err
+	}
+
+	return claims, tenant, tenantRoleMappings, nil
+}
+
+// RefreshJWKS fetches the JWKS right away, bypassing the refresh rate
+// limit, e.g. so that keys rotated at the IAM System are picked up without
+// waiting for the next background refresh. It returns an error if the fetch
+// failed, in which case the last fetched keys are kept, or if the keys are
+// not fetched from a JWKS URL.
+func (a *KeycloakAuthenticator) RefreshJWKS(ctx context.Context) error {
+	keys := a.keys.Load()
+	if keys.jwks == nil || keys.jwksURL == "" {
+		return errors.New("Tokens are not verified with keys fetched from a JWKS URL")
 	}
+
+	// the background refresh reports fetch errors to the refresh status
+	// only, before Refresh returns
+	start := time.Now()
+	if err := keys.jwks.Refresh(ctx, keyfunc.RefreshOptions{IgnoreRateLimit: true}); err != nil {
+		return errors.Errorf("Could not refresh JWKS from %s: %v", keys.jwksURL, err)
+	}
+	if status := a.refreshStatus.get(); status.LastError != nil && !status.LastErrorAt.Before(start) {
+		return errors.Errorf("Could not refresh JWKS from %s: %v", keys.jwksURL, status.LastError)
+	}
+	if a.syncKeyRotation {
+		select {
+		case <-a.keyRotation.rotated:
+			a.keysRotated(a.onKeyRotation)
+		default:
+		}
+	}
+	return nil
+}
+
+// runInBackground runs f in a goroutine until Close cancels its context.
+// It is meant for setting up the authenticator and must not be called
+// concurrently or after Close.
+func (a *KeycloakAuthenticator) runInBackground(f func(ctx context.Context)) {
+	if a.stopBackground == nil {
+		a.backgroundCtx, a.stopBackground = context.WithCancel(context.Background())
+	}
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		f(a.backgroundCtx)
+	}()
+}
+
+// Close stops the background goroutines and the background refresh of the JWKS
+func (a *KeycloakAuthenticator) Close() error {
+	if a.stopBackground != nil {
+		a.stopBackground()
+		a.background.Wait()
+	}
+	if jwks := a.keys.Load().jwks; jwks != nil {
+		jwks.EndBackground()
+	}
+	return closeAuditSink(a.auditSink)
+}
+
+// abort releases a, whose construction failed, like Close but leaving the
+// audit sink open to the caller
+func (a *KeycloakAuthenticator) abort() {
+	a.auditSink = nil
+	a.Close()
 }
@@ -0,0 +1,851 @@
+package authenticator
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("test-secret")
+
+// newTestAuthenticator returns an authenticator validating HS256 tokens
+// signed with testSecret
+func newTestAuthenticator(t *testing.T, config KeycloakConfig) *KeycloakAuthenticator {
+	t.Helper()
+	a, err := NewKeycloakAuthenticatorWithHMAC(testSecret, config)
+	if err != nil {
+		t.Fatalf("ERROR: failed to create authenticator: %s", err.Error())
+	}
+	return a
+}
+
+// signTestToken returns a token signed with testSecret carrying claims,
+// expiring in an hour unless claims sets exp
+func signTestToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	if err != nil {
+		t.Fatalf("ERROR: failed to sign token: %s", err.Error())
+	}
+	return token
+}
+
+func newTestRequest(token string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/api/v1/spire/serverinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestAudienceValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		audiences []string
+		aud       interface{} // nil omits the aud claim
+		valid     bool
+	}{
+		{"string aud, no audience configured", nil, "tornjak", true},
+		{"array aud, no audience configured", nil, []string{"tornjak", "account"}, true},
+		{"no aud, no audience configured", nil, nil, true},
+		{"string aud matching", []string{"tornjak"}, "tornjak", true},
+		{"string aud not matching", []string{"tornjak"}, "account", false},
+		{"array aud with one matching", []string{"tornjak"}, []string{"account", "tornjak"}, true},
+		{"array aud with none matching", []string{"tornjak"}, []string{"account", "other"}, false},
+		{"empty string aud", []string{"tornjak"}, "", false},
+		{"empty array aud", []string{"tornjak"}, []string{}, false},
+		{"no aud", []string{"tornjak"}, nil, false},
+		{"string aud matching second audience", []string{"tornjak", "tornjak-backend"}, "tornjak-backend", true},
+		{"array aud intersecting audiences", []string{"tornjak", "tornjak-backend"}, []string{"account", "tornjak-backend"}, true},
+		{"array aud disjoint from audiences", []string{"tornjak", "tornjak-backend"}, []string{"account", "other"}, false},
+		{"audience is no prefix match", []string{"tornjak"}, "tornjak-backend", false},
+		{"empty string aud with empty audience configured", []string{"", "tornjak"}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, KeycloakConfig{Audiences: test.audiences})
+			claims := jwt.MapClaims{}
+			if test.aud != nil {
+				claims["aud"] = test.aud
+			}
+			userInfo := a.AuthenticateRequest(newTestRequest(signTestToken(t, claims)))
+			if test.valid && userInfo.AuthenticationError != nil {
+				t.Fatalf("ERROR: expected token to be accepted, got %s", userInfo.AuthenticationError.Error())
+			}
+			if !test.valid && userInfo.AuthenticationError == nil {
+				t.Fatal("ERROR: expected token to be rejected")
+			}
+			if !test.valid && failureReason(userInfo.AuthenticationError) != failureWrongAudience {
+				t.Fatalf("ERROR: expected failure reason %s, got %s", failureWrongAudience, failureReason(userInfo.AuthenticationError))
+			}
+		})
+	}
+}
+
+func TestTranslateToTornjakRolesDeduplicates(t *testing.T) {
+	tests := []struct {
+		name   string
+		config KeycloakConfig
+		roles  []string
+		want   []string
+	}{
+		{
+			"two roles mapping to admin",
+			KeycloakConfig{RoleMappings: map[string]string{"keycloak-admin": "admin", "realm-admin": "admin", "keycloak-viewer": "viewer"}},
+			[]string{"keycloak-admin", "keycloak-viewer", "realm-admin"},
+			[]string{"admin", "viewer"},
+		},
+		{
+			"first seen order is kept",
+			KeycloakConfig{RoleMappings: map[string]string{"keycloak-admin": "admin", "realm-admin": "admin", "keycloak-viewer": "viewer"}},
+			[]string{"keycloak-viewer", "realm-admin", "keycloak-admin"},
+			[]string{"viewer", "admin"},
+		},
+		{
+			"exact mapping and pattern mapping to the same role",
+			KeycloakConfig{
+				RoleMappings:        map[string]string{"keycloak-admin": "admin"},
+				RolePatternMappings: []RolePatternMapping{{Pattern: "team-*-admin", Role: "admin"}},
+			},
+			[]string{"team-a-admin", "keycloak-admin", "team-b-admin"},
+			[]string{"admin"},
+		},
+		{
+			"composite role expanding to a mapped role",
+			KeycloakConfig{
+				RoleMappings:   map[string]string{"keycloak-admin": "admin", "keycloak-viewer": "viewer"},
+				CompositeRoles: map[string][]string{"operator": {"keycloak-admin", "keycloak-viewer"}},
+			},
+			[]string{"keycloak-viewer", "operator"},
+			[]string{"viewer", "admin"},
+		},
+		{
+			"duplicate roles passed through without mappings",
+			KeycloakConfig{},
+			[]string{"admin", "viewer", "admin"},
+			[]string{"admin", "viewer"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, test.config)
+			got := a.TranslateToTornjakRoles(test.roles)
+			if len(got) != len(test.want) {
+				t.Fatalf("ERROR: expected roles %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("ERROR: expected roles %v, got %v", test.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingRealmAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"realm_access omitted", jwt.MapClaims{"sub": "user"}},
+		{"realm_access null", jwt.MapClaims{"sub": "user", "realm_access": nil}},
+		{"realm_access without roles", jwt.MapClaims{"sub": "user", "realm_access": map[string]interface{}{}}},
+		{"realm_access roles null", jwt.MapClaims{"sub": "user", "realm_access": map[string]interface{}{"roles": nil}}},
+		{"realm_access not an object", jwt.MapClaims{"sub": "user", "realm_access": "admin"}},
+		{"resource_access null", jwt.MapClaims{"sub": "user", "resource_access": nil}},
+		{"resource_access client null", jwt.MapClaims{"sub": "user", "resource_access": map[string]interface{}{"tornjak": nil}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, KeycloakConfig{RolesClientID: "tornjak"})
+			userInfo := a.AuthenticateRequest(newTestRequest(signTestToken(t, test.claims)))
+			if userInfo.AuthenticationError != nil {
+				t.Fatalf("ERROR: expected token to be accepted, got %s", userInfo.AuthenticationError.Error())
+			}
+			if len(userInfo.Roles) != 0 {
+				t.Fatalf("ERROR: expected no roles, got %v", userInfo.Roles)
+			}
+		})
+	}
+}
+
+func TestTokenValidityWithFixedClock(t *testing.T) {
+	issuedAt := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iat": issuedAt.Unix(),
+			"nbf": issuedAt.Unix(),
+			"exp": issuedAt.Add(5 * time.Minute).Unix(),
+		}
+	}
+	tests := []struct {
+		name   string
+		config KeycloakConfig
+		now    time.Time
+		kind   error // nil if the token is valid
+	}{
+		{"valid", KeycloakConfig{}, issuedAt.Add(time.Minute), nil},
+		{"expired", KeycloakConfig{}, issuedAt.Add(5 * time.Minute), ErrTokenExpired},
+		{"expired within leeway", KeycloakConfig{Leeway: 30 * time.Second}, issuedAt.Add(5*time.Minute + 29*time.Second), nil},
+		{"expired past leeway", KeycloakConfig{Leeway: 30 * time.Second}, issuedAt.Add(5*time.Minute + 31*time.Second), ErrTokenExpired},
+		{"not yet valid", KeycloakConfig{}, issuedAt.Add(-time.Second), ErrInvalidToken},
+		{"not yet valid within leeway", KeycloakConfig{Leeway: 30 * time.Second}, issuedAt.Add(-29 * time.Second), nil},
+		{"older than max token age", KeycloakConfig{MaxTokenAge: 2 * time.Minute}, issuedAt.Add(3 * time.Minute), ErrTokenExpired},
+		{"expires within min remaining TTL", KeycloakConfig{MinRemainingTTL: 2 * time.Minute}, issuedAt.Add(4 * time.Minute), ErrTokenExpiresSoon},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, test.config)
+			a.setClock(func() time.Time { return test.now })
+			userInfo := a.AuthenticateRequest(newTestRequest(signTestToken(t, claims())))
+			if test.kind == nil && userInfo.AuthenticationError != nil {
+				t.Fatalf("ERROR: expected token to be accepted, got %s", userInfo.AuthenticationError.Error())
+			}
+			if test.kind != nil && !errors.Is(userInfo.AuthenticationError, test.kind) {
+				t.Fatalf("ERROR: expected %v, got %v", test.kind, userInfo.AuthenticationError)
+			}
+		})
+	}
+}
+
+func TestCachedTokenExpiresWithClock(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	a := newTestAuthenticator(t, KeycloakConfig{})
+	a.setClock(func() time.Time { return now })
+	token := signTestToken(t, jwt.MapClaims{"exp": now.Add(time.Minute).Unix()})
+
+	if userInfo := a.AuthenticateRequest(newTestRequest(token)); userInfo.AuthenticationError != nil {
+		t.Fatalf("ERROR: expected token to be accepted, got %s", userInfo.AuthenticationError.Error())
+	}
+	now = now.Add(time.Minute)
+	if userInfo := a.AuthenticateRequest(newTestRequest(token)); !errors.Is(userInfo.AuthenticationError, ErrTokenExpired) {
+		t.Fatalf("ERROR: expected cached token to expire, got %v", userInfo.AuthenticationError)
+	}
+}
+
+// newTestJWKSServer serves the JWKS holding jwk
+func newTestJWKSServer(t *testing.T, jwk map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{jwk}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// ecJWK returns the JWK of the public key of key, padding the coordinates
+// to the size of the curve
+func ecJWK(kid string, alg string, crv string, key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"kty": "EC", "kid": kid, "alg": alg, "use": "sig", "crv": crv,
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+func TestAsymmetricSigningAlgorithms(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    crypto.Signer
+		jwk    map[string]string
+	}{
+		{"ES256", jwt.SigningMethodES256, p256, ecJWK("es256", "ES256", "P-256", p256)},
+		{"ES384", jwt.SigningMethodES384, p384, ecJWK("es384", "ES384", "P-384", p384)},
+		{"EdDSA", jwt.SigningMethodEdDSA, edPrivate, map[string]string{
+			"kty": "OKP", "kid": "eddsa", "alg": "EdDSA", "use": "sig", "crv": "Ed25519",
+			"x": base64.RawURLEncoding.EncodeToString(edPublic),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestJWKSServer(t, test.jwk)
+			token := jwt.NewWithClaims(test.method, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+			token.Header["kid"] = test.jwk["kid"]
+			signed, err := token.SignedString(test.key)
+			if err != nil {
+				t.Fatalf("ERROR: failed to sign token: %s", err.Error())
+			}
+
+			a, err := NewKeycloakAuthenticatorWithJWKS(server.URL, KeycloakConfig{AllowInsecure: true, AllowedAlgorithms: []string{test.method.Alg()}})
+			if err != nil {
+				t.Fatalf("ERROR: failed to create authenticator: %s", err.Error())
+			}
+			defer a.Close()
+			if userInfo := a.AuthenticateRequest(newTestRequest(signed)); userInfo.AuthenticationError != nil {
+				t.Fatalf("ERROR: expected %s token to be accepted, got %s", test.method.Alg(), userInfo.AuthenticationError.Error())
+			}
+
+			// the algorithm must be allowed explicitly
+			a, err = NewKeycloakAuthenticatorWithJWKS(server.URL, KeycloakConfig{AllowInsecure: true})
+			if err != nil {
+				t.Fatalf("ERROR: failed to create authenticator: %s", err.Error())
+			}
+			defer a.Close()
+			if userInfo := a.AuthenticateRequest(newTestRequest(signed)); userInfo.AuthenticationError == nil {
+				t.Fatalf("ERROR: expected %s token to be rejected without allowing %s", test.method.Alg(), test.method.Alg())
+			}
+		})
+	}
+}
+
+// Tokens in query parameters leak into access logs, browser history and
+// Referer headers, so they are only read for the configured download paths,
+// with safe methods, and only if no header carries a token.
+func TestTokenQueryParameter(t *testing.T) {
+	a := newTestAuthenticator(t, KeycloakConfig{
+		TokenQueryParameter: "access_token",
+		TokenQueryPaths:     []string{"/api/v1/export/*"},
+	})
+	token := signTestToken(t, jwt.MapClaims{"sub": "alice"})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		valid  bool
+	}{
+		{"GET of a download path", http.MethodGet, "/api/v1/export/entries?format=json&access_token=" + token, true},
+		{"HEAD of a download path", http.MethodHead, "/api/v1/export/entries?format=json&access_token=" + token, true},
+		{"GET of another path", http.MethodGet, "/api/v1/spire/entries?format=json&access_token=" + token, false},
+		{"POST of a download path", http.MethodPost, "/api/v1/export/entries?format=json&access_token=" + token, false},
+		{"GET without the parameter", http.MethodGet, "/api/v1/export/entries?format=json", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, nil)
+			userInfo := a.AuthenticateRequest(r)
+			if test.valid && userInfo.AuthenticationError != nil {
+				t.Fatalf("ERROR: expected token to be accepted, got %s", userInfo.AuthenticationError.Error())
+			}
+			if !test.valid && userInfo.AuthenticationError == nil {
+				t.Fatalf("ERROR: expected request to be rejected")
+			}
+			// handlers downstream must not see, and log, the token
+			if test.valid && (r.URL.Query().Has("access_token") || r.URL.Query().Get("format") != "json") {
+				t.Fatalf("ERROR: expected only the token to be removed from the query, got %q", r.URL.RawQuery)
+			}
+		})
+	}
+
+	// the Authorization header takes precedence over the query
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/export/entries?access_token="+token, nil)
+	r.Header.Set("Authorization", "Bearer invalid")
+	if userInfo := a.AuthenticateRequest(r); userInfo.AuthenticationError == nil {
+		t.Fatalf("ERROR: expected the invalid header token to be used")
+	}
+
+	// the parameter is never read for every path
+	if _, err := NewKeycloakAuthenticatorWithHMAC(testSecret, KeycloakConfig{TokenQueryParameter: "access_token"}); err == nil {
+		t.Fatalf("ERROR: expected a token query parameter without paths to be rejected")
+	}
+}
+
+// A validation still running when the audiences are replaced must neither
+// be shared with nor cached for the requests that follow.
+func TestSetAudiencesDuringValidation(t *testing.T) {
+	a := newTestAuthenticator(t, KeycloakConfig{Audiences: []string{"old"}})
+	token := signTestToken(t, jwt.MapClaims{"aud": "old"})
+
+	// the clock holds the first validation until the audiences are replaced
+	validating := make(chan struct{})
+	replaced := make(chan struct{})
+	var once sync.Once
+	a.setClock(func() time.Time {
+		once.Do(func() {
+			close(validating)
+			<-replaced
+		})
+		return time.Now()
+	})
+	done := make(chan error)
+	go func() {
+		done <- a.AuthenticateRequest(newTestRequest(token)).AuthenticationError
+	}()
+	<-validating
+	a.SetAudiences([]string{"new"})
+	close(replaced)
+	if err := <-done; err != nil {
+		t.Fatalf("ERROR: expected the validation started before SetAudiences to accept the token, got %s", err.Error())
+	}
+
+	userInfo := a.AuthenticateRequest(newTestRequest(token))
+	if failureReason(userInfo.AuthenticationError) != failureWrongAudience {
+		t.Fatalf("ERROR: expected the old audience to be rejected after SetAudiences, got %v", userInfo.AuthenticationError)
+	}
+}
+
+// While a lower-priority JWKS URL is in use, the first is switched back to
+// once it serves a JWKS again.
+func TestJWKSFailback(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk := ecJWK("es256", "ES256", "P-256", key)
+	var primaryUp atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !primaryUp.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{jwk}})
+	}))
+	defer primary.Close()
+	secondary := newTestJWKSServer(t, jwk)
+
+	a, err := NewKeycloakAuthenticatorWithJWKSURLs([]string{primary.URL, secondary.URL}, KeycloakConfig{
+		AllowInsecure: true,
+		JWKS:          JWKSConfig{RefreshInterval: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("ERROR: failed to create authenticator: %s", err.Error())
+	}
+	defer a.Close()
+	if url := a.keys.Load().jwksURL; url != secondary.URL {
+		t.Fatalf("ERROR: expected JWKS URL %s while the first is down, got %s", secondary.URL, url)
+	}
+
+	primaryUp.Store(true)
+	for deadline := time.Now().Add(5 * time.Second); a.keys.Load().jwksURL != primary.URL; {
+		if time.Now().After(deadline) {
+			t.Fatalf("ERROR: expected JWKS URL %s once it recovered, got %s", primary.URL, a.keys.Load().jwksURL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tokens granting a single-use role are accepted once per jti, including by
+// requests sharing one validation, and only if they carry jti and exp.
+func TestSingleUseTokens(t *testing.T) {
+	admin := map[string]interface{}{"roles": []string{"admin"}}
+	viewer := map[string]interface{}{"roles": []string{"viewer"}}
+	noExp, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"jti": "no-exp", "realm_access": admin}).SignedString(testSecret)
+	if err != nil {
+		t.Fatalf("ERROR: failed to sign token: %s", err.Error())
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		uses  int // number of uses accepted, of two
+	}{
+		{"single-use role", signTestToken(t, jwt.MapClaims{"jti": "admin", "realm_access": admin}), 1},
+		{"single-use role without jti", signTestToken(t, jwt.MapClaims{"realm_access": admin}), 0},
+		{"single-use role without exp", noExp, 0},
+		{"other role without jti", signTestToken(t, jwt.MapClaims{"realm_access": viewer}), 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, KeycloakConfig{SingleUseRoles: []string{"admin"}})
+			uses := 0
+			for i := 0; i < 2; i++ {
+				if userInfo := a.AuthenticateRequest(newTestRequest(test.token)); userInfo.AuthenticationError == nil {
+					uses++
+				} else if i == 1 && uses == 1 && failureReason(userInfo.AuthenticationError) != failureReplayed {
+					t.Fatalf("ERROR: expected the second use to be rejected as replayed, got %s", userInfo.AuthenticationError.Error())
+				}
+			}
+			if uses != test.uses {
+				t.Fatalf("ERROR: expected %d of 2 uses to be accepted, got %d", test.uses, uses)
+			}
+		})
+	}
+
+	t.Run("concurrent requests sharing a validation", func(t *testing.T) {
+		a := newTestAuthenticator(t, KeycloakConfig{SingleUseRoles: []string{"admin"}})
+		token := signTestToken(t, jwt.MapClaims{"jti": "shared", "realm_access": admin})
+
+		// the clock holds the first validation until the second request
+		// has had time to join it
+		validating := make(chan struct{})
+		release := make(chan struct{})
+		var once sync.Once
+		a.setClock(func() time.Time {
+			once.Do(func() {
+				close(validating)
+				<-release
+			})
+			return time.Now()
+		})
+		results := make(chan error, 2)
+		authenticate := func() {
+			results <- a.AuthenticateRequest(newTestRequest(token)).AuthenticationError
+		}
+		go authenticate()
+		<-validating
+		go authenticate()
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		uses := 0
+		for i := 0; i < 2; i++ {
+			if err := <-results; err == nil {
+				uses++
+			}
+		}
+		if uses != 1 {
+			t.Fatalf("ERROR: expected 1 of 2 concurrent uses to be accepted, got %d", uses)
+		}
+	})
+
+	t.Run("full cache", func(t *testing.T) {
+		a := newTestAuthenticator(t, KeycloakConfig{SingleUseRoles: []string{"admin"}})
+		for i := 0; i < replayCacheMaxEntries; i++ {
+			a.replayCache.entries[strconv.Itoa(i)] = time.Now().Add(time.Hour)
+		}
+		token := signTestToken(t, jwt.MapClaims{"jti": "new", "realm_access": admin})
+		if userInfo := a.AuthenticateRequest(newTestRequest(token)); userInfo.AuthenticationError == nil {
+			t.Fatalf("ERROR: expected a single-use token to be rejected while the replay cache is full")
+		}
+
+		// expired entries make room
+		for jti := range a.replayCache.entries {
+			a.replayCache.entries[jti] = time.Now().Add(-time.Minute)
+		}
+		if userInfo := a.AuthenticateRequest(newTestRequest(token)); userInfo.AuthenticationError != nil {
+			t.Fatalf("ERROR: expected a single-use token to be accepted once expired entries are removed, got %s", userInfo.AuthenticationError.Error())
+		}
+	})
+}
+
+// X-Forwarded-For is only trusted for the configured number of proxies,
+// counted from the remote address.
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string // one X-Forwarded-For header per value
+		trustedProxies int
+		want           string // empty if the request is refused
+	}{
+		{"no proxies", "10.0.0.1:1234", nil, 0, "10.0.0.1"},
+		{"no proxies with spoofed header", "10.0.0.1:1234", []string{"203.0.113.7"}, 0, "10.0.0.1"},
+		{"one proxy", "10.0.0.1:1234", []string{"203.0.113.7"}, 1, "203.0.113.7"},
+		{"two proxies", "10.0.0.1:1234", []string{"203.0.113.7, 10.0.0.2"}, 2, "203.0.113.7"},
+		{"two proxies with spoofed header", "10.0.0.1:1234", []string{"192.0.2.1, 203.0.113.7, 10.0.0.2"}, 2, "203.0.113.7"},
+		{"repeated headers", "10.0.0.1:1234", []string{"192.0.2.1", "203.0.113.7", "10.0.0.2"}, 2, "203.0.113.7"},
+		{"fewer hops than proxies", "10.0.0.1:1234", []string{"203.0.113.7"}, 2, ""},
+		{"proxy without header", "10.0.0.1:1234", nil, 1, ""},
+		{"IPv6 remote address", "[2001:db8::1]:443", nil, 0, "2001:db8::1"},
+		{"IPv6 client behind proxy", "[2001:db8::1]:443", []string{"2001:db8::7"}, 1, "2001:db8::7"},
+		{"invalid forwarded address", "10.0.0.1:1234", []string{"unknown"}, 1, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			ip, err := clientIP(r, test.trustedProxies)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("ERROR: expected the request to be refused, got %s", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ERROR: expected client %s, got %s", test.want, err.Error())
+			}
+			if !ip.Equal(net.ParseIP(test.want)) {
+				t.Fatalf("ERROR: expected client %s, got %s", test.want, ip)
+			}
+		})
+	}
+}
+
+// Encrypted tokens are decrypted with the allowed algorithms only, and the
+// JWT they wrap is validated like any other.
+func TestEncryptedTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("ERROR: failed to generate key: %s", err.Error())
+	}
+	encrypt := func(t *testing.T, alg jose.KeyAlgorithm, enc jose.ContentEncryption, token string) string {
+		t.Helper()
+		encrypter, err := jose.NewEncrypter(enc, jose.Recipient{Algorithm: alg, Key: &key.PublicKey}, (&jose.EncrypterOptions{}).WithContentType("JWT"))
+		if err != nil {
+			t.Fatalf("ERROR: failed to create encrypter: %s", err.Error())
+		}
+		object, err := encrypter.Encrypt([]byte(token))
+		if err != nil {
+			t.Fatalf("ERROR: failed to encrypt token: %s", err.Error())
+		}
+		encrypted, err := object.CompactSerialize()
+		if err != nil {
+			t.Fatalf("ERROR: failed to serialize token: %s", err.Error())
+		}
+		return encrypted
+	}
+	valid := signTestToken(t, jwt.MapClaims{"sub": "alice"})
+	expired := signTestToken(t, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("other-secret"))
+	if err != nil {
+		t.Fatalf("ERROR: failed to sign token: %s", err.Error())
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string // failure reason, empty if the token is accepted
+	}{
+		{"RSA-OAEP with A256GCM", encrypt(t, jose.RSA_OAEP, jose.A256GCM, valid), ""},
+		{"RSA-OAEP-256 with A256GCM", encrypt(t, jose.RSA_OAEP_256, jose.A256GCM, valid), ""},
+		{"disallowed key algorithm", encrypt(t, jose.RSA1_5, jose.A256GCM, valid), failureInvalidToken},
+		{"disallowed content encryption", encrypt(t, jose.RSA_OAEP, jose.A128GCM, valid), failureInvalidToken},
+		{"wrapped token with invalid signature", encrypt(t, jose.RSA_OAEP, jose.A256GCM, forged), failureInvalidSignature},
+		{"wrapped token expired", encrypt(t, jose.RSA_OAEP, jose.A256GCM, expired), failureExpired},
+		{"plain token", valid, failureInvalidToken},
+	}
+	a := newTestAuthenticator(t, KeycloakConfig{DecryptionKey: key, RequireEncryption: true})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userInfo := a.AuthenticateRequest(newTestRequest(test.token))
+			if test.reason == "" {
+				if userInfo.AuthenticationError != nil {
+					t.Fatalf("ERROR: expected token to be accepted, got %s", userInfo.AuthenticationError.Error())
+				}
+				if userInfo.Subject != "alice" {
+					t.Fatalf("ERROR: expected subject alice, got %q", userInfo.Subject)
+				}
+				return
+			}
+			if reason := failureReason(userInfo.AuthenticationError); reason != test.reason {
+				t.Fatalf("ERROR: expected failure %q, got %q: %v", test.reason, reason, userInfo.AuthenticationError)
+			}
+		})
+	}
+
+	// without RequireEncryption, plain tokens remain accepted
+	a = newTestAuthenticator(t, KeycloakConfig{DecryptionKey: key})
+	if userInfo := a.AuthenticateRequest(newTestRequest(valid)); userInfo.AuthenticationError != nil {
+		t.Fatalf("ERROR: expected plain token to be accepted, got %s", userInfo.AuthenticationError.Error())
+	}
+}
+
+// Only tokens whose kid is allowed are verified, even with keys of other
+// IDs served by the JWKS endpoint.
+func TestAllowedKIDs(t *testing.T) {
+	trusted, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	advertised, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			ecJWK("trusted", "ES256", "P-256", trusted),
+			ecJWK("advertised", "ES256", "P-256", advertised),
+		}})
+	}))
+	defer server.Close()
+	sign := func(t *testing.T, kid string, key *ecdsa.PrivateKey) string {
+		t.Helper()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("ERROR: failed to sign token: %s", err.Error())
+		}
+		return signed
+	}
+
+	a, err := NewKeycloakAuthenticatorWithJWKS(server.URL, KeycloakConfig{
+		AllowInsecure:     true,
+		AllowedAlgorithms: []string{"ES256"},
+		AllowedKIDs:       []string{"trusted"},
+	})
+	if err != nil {
+		t.Fatalf("ERROR: failed to create authenticator: %s", err.Error())
+	}
+	defer a.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		message string // contained in the error, empty if the token is accepted
+	}{
+		{"allowed kid", sign(t, "trusted", trusted), ""},
+		{"kid served by the JWKS but not allowed", sign(t, "advertised", advertised), "is not one of the allowed key IDs"},
+		{"no kid", sign(t, "", trusted), "Token has no key ID"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := a.AuthenticateRequest(newTestRequest(test.token)).AuthenticationError
+			if test.message == "" {
+				if err != nil {
+					t.Fatalf("ERROR: expected token to be accepted, got %s", err.Error())
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("ERROR: expected invalid token error containing %q, got %v", test.message, err)
+			}
+		})
+	}
+}
+
+// newTestLoginServer returns an issuer serving OIDC discovery, the JWKS of
+// key and a token endpoint issuing access tokens signed with key. The form
+// of the last token request is stored in tokenRequest.
+func newTestLoginServer(t *testing.T, key *ecdsa.PrivateKey, tokenRequest *url.Values) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"jwks_uri":               server.URL + "/jwks",
+			"authorization_endpoint": server.URL + "/auth",
+			"token_endpoint":         server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{ecJWK("login", "ES256", "P-256", key)}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*tokenRequest = r.PostForm
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss": server.URL,
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "login"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": signed, "token_type": "Bearer", "expires_in": 3600})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// The login callback only accepts the state it issued, once, and redeems
+// the code with the PKCE verifier kept with the state.
+func TestLoginCallback(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var tokenRequest url.Values
+	server := newTestLoginServer(t, key, &tokenRequest)
+	newLoginAuthenticator := func(t *testing.T, redirectURL string) *KeycloakAuthenticator {
+		t.Helper()
+		a, err := NewKeycloakAuthenticator(context.Background(), true, KeycloakConfig{
+			IssuerURL:         server.URL,
+			AllowInsecure:     true,
+			AllowedAlgorithms: []string{"ES256"},
+			TokenCookieName:   "tornjak_token",
+			Login:             &LoginConfig{ClientID: "tornjak", RedirectURL: redirectURL},
+		})
+		if err != nil {
+			t.Fatalf("ERROR: failed to create authenticator: %s", err.Error())
+		}
+		t.Cleanup(func() { a.Close() })
+		return a
+	}
+	// startLogin returns the login cookie set when starting a login
+	startLogin := func(t *testing.T, a *KeycloakAuthenticator) *http.Cookie {
+		t.Helper()
+		login, _ := a.LoginHandlers()
+		w := httptest.NewRecorder()
+		login(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == loginCookieName {
+				return cookie
+			}
+		}
+		t.Fatalf("ERROR: expected the login cookie to be set")
+		return nil
+	}
+	callbackRequest := func(state string, cookie *http.Cookie) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/callback?code=test-code&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+
+	t.Run("state mismatch", func(t *testing.T) {
+		a := newLoginAuthenticator(t, "https://tornjak.example.com/callback")
+		_, callback := a.LoginHandlers()
+		cookie := startLogin(t, a)
+		for _, r := range []*http.Request{callbackRequest("forged", cookie), callbackRequest("forged", nil)} {
+			w := httptest.NewRecorder()
+			callback(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("ERROR: expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	t.Run("code exchange", func(t *testing.T) {
+		a := newLoginAuthenticator(t, "https://tornjak.example.com/callback")
+		_, callback := a.LoginHandlers()
+		cookie := startLogin(t, a)
+		if !cookie.Secure || cookie.Path != "/callback" {
+			t.Fatalf("ERROR: expected a secure login cookie for /callback, got secure %t and path %q", cookie.Secure, cookie.Path)
+		}
+		state, verifier, _ := strings.Cut(cookie.Value, ".")
+
+		w := httptest.NewRecorder()
+		callback(w, callbackRequest(state, cookie))
+		if w.Code != http.StatusFound {
+			t.Fatalf("ERROR: expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		if tokenRequest.Get("code") != "test-code" || tokenRequest.Get("code_verifier") != verifier {
+			t.Fatalf("ERROR: expected the code to be exchanged with the PKCE verifier, got %v", tokenRequest)
+		}
+		cleared, token := false, false
+		for _, cookie := range w.Result().Cookies() {
+			switch cookie.Name {
+			case loginCookieName:
+				cleared = cookie.MaxAge < 0 && cookie.Value == ""
+			case "tornjak_token":
+				token = cookie.Secure && cookie.Value != ""
+			}
+		}
+		if !cleared || !token {
+			t.Fatalf("ERROR: expected the login cookie to be cleared and a secure token cookie to be set, got %v", w.Result().Cookies())
+		}
+	})
+
+	t.Run("http redirect URL", func(t *testing.T) {
+		a := newLoginAuthenticator(t, "http://localhost:10000/callback")
+		if cookie := startLogin(t, a); cookie.Secure {
+			t.Fatalf("ERROR: expected the login cookie not to be secure for an http redirect URL")
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package authenticator
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+var (
+	defaultAllowedAlgorithms     = []string{"RS256"}
+	defaultHMACAllowedAlgorithms = []string{jwt.SigningMethodHS256.Alg()}
+)
+
+// resolveAllowedAlgorithms returns the signing algorithms accepted by the
+// parser, rejecting "none", unknown algorithms and any algorithm the key
+// source of the authenticator cannot be used with
+func resolveAllowedAlgorithms(algs []string, hmac bool) ([]string, error) {
+	if len(algs) == 0 {
+		if hmac {
+			return defaultHMACAllowedAlgorithms, nil
+		}
+		return defaultAllowedAlgorithms, nil
+	}
+	for _, alg := range algs {
+		method := jwt.GetSigningMethod(alg)
+		if method == nil || method == jwt.SigningMethodNone {
+			return nil, errors.Errorf("Signing algorithm %q is not supported", alg)
+		}
+		_, isHMAC := method.(*jwt.SigningMethodHMAC)
+		if hmac && method != jwt.SigningMethodHS256 {
+			return nil, errors.Errorf("Signing algorithm %q cannot be used with an HMAC secret, only HS256 is supported", alg)
+		}
+		if !hmac && isHMAC {
+			return nil, errors.Errorf("Signing algorithm %q cannot be used with asymmetric keys", alg)
+		}
+	}
+	return algs, nil
+}
+
+// algorithmAllowed reports whether the algorithm of the token header is
+// one of the allowed algorithms
+func algorithmAllowed(token *jwt.Token, allowedAlgs []string) bool {
+	if token == nil {
+		return true
+	}
+	alg, _ := token.Header["alg"].(string)
+	for _, allowed := range allowedAlgs {
+		if alg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// errKIDNotAllowed is the cause of errors rejecting a token whose kid is not
+// in the kid allowlist
+var errKIDNotAllowed = errors.New("kid not allowed")
+
+// kidAllowlistKeyfunc wraps keyFunc so that tokens whose kid header is not
+// in allowedKIDs are rejected before keyFunc is consulted, whatever keys
+// the key source holds
+func kidAllowlistKeyfunc(allowedKIDs map[string]struct{}, keyFunc jwt.Keyfunc) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if _, ok := allowedKIDs[kid]; !ok || kid == "" {
+			return nil, errKIDNotAllowed
+		}
+		return keyFunc(token)
+	}
+}
+
+// asymmetricKeyfunc wraps a JWKS keyfunc so that HMAC signed tokens are
+// always rejected, preventing algorithm confusion with public keys
+func asymmetricKeyfunc(keyFunc jwt.Keyfunc) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return nil, errors.Errorf("Unexpected signing method %s: authenticator is configured for asymmetric keys", token.Method.Alg())
+		}
+		return keyFunc(token)
+	}
+}
+
+// hmacKeyfunc returns a keyfunc validating HS256 tokens with a shared secret
+func hmacKeyfunc(secret []byte) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.Errorf("Unexpected signing method %s: authenticator is configured for HS256", token.Method.Alg())
+		}
+		return secret, nil
+	}
+}
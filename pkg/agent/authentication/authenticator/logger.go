@@ -0,0 +1,33 @@
+package authenticator
+
+import "fmt"
+
+// Logger receives the diagnostic output of the authenticators
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdoutLogger is the default Logger, printing every message to stdout
+type stdoutLogger struct{}
+
+func (stdoutLogger) Debugf(format string, args ...interface{}) {
+	fmt.Printf("DEBUG: "+format+"\n", args...)
+}
+
+func (stdoutLogger) Warnf(format string, args ...interface{}) {
+	fmt.Printf("WARNING: "+format+"\n", args...)
+}
+
+func (stdoutLogger) Errorf(format string, args ...interface{}) {
+	fmt.Printf("ERROR: "+format+"\n", args...)
+}
+
+// loggerOrDefault returns logger, or the stdout logger if it is nil
+func loggerOrDefault(logger Logger) Logger {
+	if logger == nil {
+		return stdoutLogger{}
+	}
+	return logger
+}
@@ -0,0 +1,265 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// name of the cookie holding the state and PKCE verifier of a login
+const loginCookieName = "tornjak_login"
+
+// how long a login started may take to return to the callback
+const loginTimeout = 10 * time.Minute
+
+// LoginConfig configures the browser login flow, i.e. the OAuth 2.0
+// authorization code flow with PKCE against the issuer
+type LoginConfig struct {
+	// ClientID identifies Tornjak at the issuer
+	ClientID string
+	// ClientSecret authenticates confidential clients, empty for public ones
+	ClientSecret string
+	// RedirectURL is the URL of the callback handler, to which the issuer
+	// returns the browser; it must be registered for the client
+	RedirectURL string
+	// Scopes lists the requested scopes, defaults to "openid"
+	Scopes []string
+	// PostLoginURL is where the browser is sent once logged in, defaults to "/"
+	PostLoginURL string
+	// PostLogoutURL is where the issuer sends the browser once logged out;
+	// it must be absolute and registered for the client. Defaults to the
+	// issuer's choice, or "/" if the issuer has no end_session_endpoint.
+	PostLogoutURL string
+}
+
+// LoginHandlers is implemented by authenticators that log in browser users
+type LoginHandlers interface {
+	// LoginHandlers returns the handler redirecting the browser to the
+	// issuer and the handler serving LoginConfig.RedirectURL, or nil
+	// handlers if no login is configured
+	LoginHandlers() (login http.HandlerFunc, callback http.HandlerFunc)
+	// LogoutHandler returns the handler ending the session of the browser,
+	// to be served for POST only as it is not CSRF protected otherwise, or
+	// nil if no login is configured
+	LogoutHandler() http.HandlerFunc
+}
+
+var _ LoginHandlers = (*KeycloakAuthenticator)(nil)
+
+// login holds a validated LoginConfig
+type login struct {
+	LoginConfig
+	callbackPath string
+	// cookies are only sent over https if the redirect URL is https, also
+	// when TLS is terminated in front of the server
+	secureCookies bool
+}
+
+func newLogin(config LoginConfig, cookieName string) (*login, error) {
+	if config.ClientID == "" {
+		return nil, errors.New("A client ID is required for login")
+	}
+	if cookieName == "" {
+		return nil, errors.New("A token cookie name is required for login")
+	}
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil || !redirectURL.IsAbs() {
+		return nil, errors.Errorf("Login redirect URL %q is no absolute URL", config.RedirectURL)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid"}
+	}
+	if config.PostLoginURL == "" {
+		config.PostLoginURL = "/"
+	}
+	callbackPath := redirectURL.Path
+	if callbackPath == "" {
+		callbackPath = "/"
+	}
+	return &login{LoginConfig: config, callbackPath: callbackPath, secureCookies: redirectURL.Scheme == "https"}, nil
+}
+
+func (a *KeycloakAuthenticator) LoginHandlers() (http.HandlerFunc, http.HandlerFunc) {
+	if a.login == nil {
+		return nil, nil
+	}
+	return a.startLogin, a.loginCallback
+}
+
+func (a *KeycloakAuthenticator) LogoutHandler() http.HandlerFunc {
+	if a.login == nil {
+		return nil
+	}
+	return a.logout
+}
+
+// idTokenCookieName returns the name of the cookie holding the ID token,
+// sent as id_token_hint on logout
+func (a *KeycloakAuthenticator) idTokenCookieName() string {
+	return a.cookieName + "_id"
+}
+
+// oauth2Config returns the client of the login flow, with the endpoints of
+// the last OIDC discovery
+func (a *KeycloakAuthenticator) oauth2Config() *oauth2.Config {
+	metadata := a.keys.Load().metadata
+	return &oauth2.Config{
+		ClientID:     a.login.ClientID,
+		ClientSecret: a.login.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+		RedirectURL: a.login.RedirectURL,
+		Scopes:      a.login.Scopes,
+	}
+}
+
+// startLogin redirects the browser to the authorization endpoint. The state
+// and PKCE verifier are kept in a cookie sent only to the callback.
+func (a *KeycloakAuthenticator) startLogin(w http.ResponseWriter, r *http.Request) {
+	state := oauth2.GenerateVerifier()
+	verifier := oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    state + "." + verifier,
+		Path:     a.login.callbackPath,
+		MaxAge:   int(loginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   a.login.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, a.oauth2Config().AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// loginCallback exchanges the authorization code for tokens and stores the
+// access token, once validated, in the token cookie
+func (a *KeycloakAuthenticator) loginCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if code := query.Get("error"); code != "" {
+		http.Error(w, fmt.Sprintf("Login failed: %s %s", code, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+	var state, verifier string
+	if cookie, err := r.Cookie(loginCookieName); err == nil {
+		state, verifier, _ = strings.Cut(cookie.Value, ".")
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		http.Error(w, "Login state is missing or does not match, please log in again", http.StatusBadRequest)
+		return
+	}
+	// the state is only used once
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Path:     a.login.callbackPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.login.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	ctx := r.Context()
+	if a.httpClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, a.httpClient)
+	}
+	token, err := a.oauth2Config().Exchange(ctx, query.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		a.logger.Errorf("Could not exchange authorization code: %v", err)
+		http.Error(w, "Could not exchange authorization code", http.StatusBadGateway)
+		return
+	}
+	userInfo := a.authenticateToken(ctx, token.AccessToken, r)
+	if err := userInfo.AuthenticationError; err != nil {
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.cookieName,
+		Value:    token.AccessToken,
+		Path:     "/",
+		Expires:  token.Expiry,
+		HttpOnly: true,
+		Secure:   a.login.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// the ID token is kept for the browser session, which the issuer's
+	// session usually outlives the access token in
+	if idToken, ok := token.Extra("id_token").(string); ok && idToken != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     a.idTokenCookieName(),
+			Value:    idToken,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   a.login.secureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(w, r, a.login.PostLoginURL, http.StatusFound)
+}
+
+// logout clears the token cookies, drops the token from the token cache and
+// redirects the browser, with a GET, to the end_session_endpoint of the
+// issuer, if any
+func (a *KeycloakAuthenticator) logout(w http.ResponseWriter, r *http.Request) {
+	if token, err := a.getRequestToken(r); err == nil {
+		if a.tokenCache != nil {
+			a.tokenCache.remove(tokenCacheKey(token, a.requestHost(r)))
+		}
+		// the signature is not checked, a forged token at most drops the
+		// cached roles of its subject
+		claims := &KeycloakClaim{}
+		if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err == nil && claims.Subject != "" {
+			if a.roleCache != nil {
+				tenant, _, _ := a.verifyTenant(claims)
+				a.roleCache.removeSubject(tenant, claims.Subject)
+			}
+			if a.userInfoCache != nil {
+				a.userInfoCache.remove(claims.Subject)
+			}
+		}
+	}
+	var idToken string
+	if cookie, err := r.Cookie(a.idTokenCookieName()); err == nil {
+		idToken = cookie.Value
+	}
+	for _, name := range []string{a.cookieName, a.idTokenCookieName()} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   a.login.secureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	endSession, err := url.Parse(a.keys.Load().metadata.EndSessionEndpoint)
+	if err != nil || endSession.String() == "" {
+		// the issuer session stays, only Tornjak's cookies are cleared
+		postLogoutURL := a.login.PostLogoutURL
+		if postLogoutURL == "" {
+			postLogoutURL = "/"
+		}
+		http.Redirect(w, r, postLogoutURL, http.StatusSeeOther)
+		return
+	}
+	query := endSession.Query()
+	query.Set("client_id", a.login.ClientID)
+	if idToken != "" {
+		query.Set("id_token_hint", idToken)
+	}
+	if a.login.PostLogoutURL != "" {
+		query.Set("post_logout_redirect_uri", a.login.PostLogoutURL)
+	}
+	endSession.RawQuery = query.Encode()
+	http.Redirect(w, r, endSession.String(), http.StatusSeeOther)
+}
@@ -0,0 +1,206 @@
+package authenticator
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// reasons authentications fail, as reported by the failures metric
+const (
+	failureNoToken           = "no_token"
+	failureInvalidSignature  = "invalid_signature"
+	failureExpired           = "expired"
+	failureExpiresSoon       = "expires_soon"
+	failureNotYetValid       = "not_yet_valid"
+	failureWrongAudience     = "wrong_audience"
+	failureWrongIssuer       = "wrong_issuer"
+	failureWrongTokenType    = "wrong_token_type"
+	failureInsufficientRoles = "insufficient_roles"
+	failureReplayed          = "replayed"
+	failureUntrustedNetwork  = "untrusted_network"
+	failureEmailNotVerified  = "email_not_verified"
+	failureInvalidToken      = "invalid_token"
+)
+
+var failureReasons = []string{
+	failureNoToken,
+	failureInvalidSignature,
+	failureExpired,
+	failureExpiresSoon,
+	failureNotYetValid,
+	failureWrongAudience,
+	failureWrongIssuer,
+	failureWrongTokenType,
+	failureInsufficientRoles,
+	failureReplayed,
+	failureUntrustedNetwork,
+	failureEmailNotVerified,
+	failureInvalidToken,
+}
+
+// Metrics records authentication outcomes. It is a prometheus.Collector
+// to be registered by the caller, and a nil *Metrics records nothing.
+type Metrics struct {
+	authentications prometheus.Counter
+	failures        *prometheus.CounterVec
+	duration        prometheus.Histogram
+	unmappedRoles   prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		authentications: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "tornjak",
+			Name:      "authentications_total",
+			Help:      "Total number of authentication attempts.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tornjak",
+			Name:      "authentication_failures_total",
+			Help:      "Number of failed authentication attempts by reason.",
+		}, []string{"reason"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "tornjak",
+			Name:      "token_validation_duration_seconds",
+			Help:      "Latency of validating a token, including cache hits.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		unmappedRoles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "tornjak",
+			Name:      "unmapped_roles_total",
+			Help:      "Number of token roles dropped for lack of a Tornjak role mapping.",
+		}),
+	}
+	// report every reason from the start, so that rates can be computed
+	for _, reason := range failureReasons {
+		m.failures.WithLabelValues(reason)
+	}
+	return m
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.authentications.Describe(ch)
+	m.failures.Describe(ch)
+	m.duration.Describe(ch)
+	m.unmappedRoles.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.authentications.Collect(ch)
+	m.failures.Collect(ch)
+	m.duration.Collect(ch)
+	m.unmappedRoles.Collect(ch)
+}
+
+// MetricsExporter is implemented by authenticators that can serve the
+// metrics they record
+type MetricsExporter interface {
+	// MetricsHandler returns the handler serving the metrics in the
+	// Prometheus exposition format, or nil if no metrics are recorded
+	MetricsHandler() http.Handler
+}
+
+var (
+	_ MetricsExporter = (*KeycloakAuthenticator)(nil)
+	_ MetricsExporter = (*MultiIssuerAuthenticator)(nil)
+	_ MetricsExporter = (*ChainAuthenticator)(nil)
+)
+
+// MetricsHandler serves the metrics of KeycloakConfig.Metrics, if set
+func (a *KeycloakAuthenticator) MetricsHandler() http.Handler {
+	return a.metrics.handler()
+}
+
+// MetricsHandler serves the metrics of KeycloakConfig.Metrics, if set,
+// which are shared by the authenticators of all issuers
+func (a *MultiIssuerAuthenticator) MetricsHandler() http.Handler {
+	return a.metrics.handler()
+}
+
+// MetricsHandler serves the metrics of the first authenticator in the
+// chain recording any
+func (a *ChainAuthenticator) MetricsHandler() http.Handler {
+	for _, authenticator := range a.authenticators {
+		if exporter, ok := authenticator.(MetricsExporter); ok {
+			if handler := exporter.MetricsHandler(); handler != nil {
+				return handler
+			}
+		}
+	}
+	return nil
+}
+
+// handler serves m from a registry of its own, nil if m is nil
+func (m *Metrics) handler() http.Handler {
+	if m == nil {
+		return nil
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// observeAuthentication counts an authentication attempt failing with err,
+// or succeeding if err is nil
+func (m *Metrics) observeAuthentication(err error) {
+	if m == nil {
+		return
+	}
+	m.authentications.Inc()
+	if err != nil {
+		m.failures.WithLabelValues(failureReason(err)).Inc()
+	}
+}
+
+// observeValidation records how long validating a token took
+func (m *Metrics) observeValidation(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.duration.Observe(d.Seconds())
+}
+
+// observeUnmappedRole counts a token role without a Tornjak role mapping
+func (m *Metrics) observeUnmappedRole() {
+	if m == nil {
+		return
+	}
+	m.unmappedRoles.Inc()
+}
+
+// failureReason classifies an authentication error for the failures metric
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrInsufficientRoles):
+		return failureInsufficientRoles
+	case errors.Is(err, ErrNoToken) && !errors.Is(err, ErrInvalidToken):
+		return failureNoToken
+	case errors.Is(err, ErrTokenExpired):
+		return failureExpired
+	case errors.Is(err, ErrTokenExpiresSoon):
+		return failureExpiresSoon
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return failureNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return failureWrongAudience
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return failureWrongIssuer
+	case errors.Is(err, ErrWrongTokenType):
+		return failureWrongTokenType
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return failureInvalidSignature
+	case errors.Is(err, errTokenReplayed):
+		return failureReplayed
+	case errors.Is(err, ErrUntrustedNetwork):
+		return failureUntrustedNetwork
+	case errors.Is(err, ErrEmailNotVerified):
+		return failureEmailNotVerified
+	default:
+		return failureInvalidToken
+	}
+}
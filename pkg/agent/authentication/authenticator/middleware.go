@@ -0,0 +1,132 @@
+package authenticator
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// TokenExpiresAtHeader is the response header telling clients when the
+// token of a successfully authenticated request expires, in RFC 3339
+// format, so that they can refresh it in time without parsing it
+const TokenExpiresAtHeader = "X-Token-Expires-At"
+
+// SetTokenExpiresAtHeader sets the TokenExpiresAtHeader of w to the expiry
+// of the token userInfo was authenticated by, if it authenticated the
+// request and expires
+func SetTokenExpiresAtHeader(w http.ResponseWriter, userInfo *user.UserInfo) {
+	if userInfo == nil || userInfo.AuthenticationError != nil || userInfo.ExpiresAt.IsZero() {
+		return
+	}
+	w.Header().Set(TokenExpiresAtHeader, userInfo.ExpiresAt.UTC().Format(time.RFC3339))
+}
+
+// UserInfoMiddleware authenticates each request and, on success, stores the
+// UserInfo in the request context for next to read with
+// user.UserInfoFromContext. Requests failing authentication are passed on
+// without UserInfo, leaving the decision to next or an authorization layer.
+func UserInfoMiddleware(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userInfo := a.AuthenticateRequest(r)
+		if userInfo != nil && userInfo.AuthenticationError == nil {
+			r = r.WithContext(user.ContextWithUserInfo(r.Context(), userInfo))
+			SetTokenExpiresAtHeader(w, userInfo)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware authenticates each request before delegating to next, storing
+// the UserInfo in the request context. Requests failing authentication get
+// 401 Unauthorized with the WWW-Authenticate challenge from Challenge. If
+// requiredRoles are given, users holding none of them get 403 Forbidden.
+func (a *KeycloakAuthenticator) Middleware(next http.Handler, requiredRoles ...string) http.Handler {
+	return authenticationMiddleware(a, next, requiredRoles)
+}
+
+func authenticationMiddleware(a Authenticator, next http.Handler, requiredRoles []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userInfo := a.AuthenticateRequest(r)
+		if userInfo == nil {
+			userInfo = wrapAuthenticationError(newAuthError(ErrNoToken, nil, "Request could not be authenticated"))
+		}
+		if userInfo.AuthenticationError == nil && !hasAnyRole(userInfo.Roles, requiredRoles) {
+			userInfo = wrapAuthenticationError(newAuthError(ErrInsufficientRoles, nil, "User has none of the required roles %v", requiredRoles))
+		}
+		if err := userInfo.AuthenticationError; err != nil {
+			w.Header().Set("WWW-Authenticate", Challenge(err))
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		SetTokenExpiresAtHeader(w, userInfo)
+		next.ServeHTTP(w, r.WithContext(user.ContextWithUserInfo(r.Context(), userInfo)))
+	})
+}
+
+// RoleMatch selects how RequireRolesMatching matches the required roles
+type RoleMatch int
+
+const (
+	// MatchAny requires the user to hold at least one of the roles
+	MatchAny RoleMatch = iota
+	// MatchAll requires the user to hold every one of the roles
+	MatchAll
+)
+
+// RequireRoles guards next so that only users holding at least one of roles
+// reach it, see RequireRolesMatching
+func RequireRoles(next http.Handler, roles ...string) http.Handler {
+	return RequireRolesMatching(next, MatchAny, roles...)
+}
+
+// RequireRolesMatching guards next by the roles of the UserInfo stored in
+// the request context by Middleware or UserInfoMiddleware. Requests without
+// UserInfo get 401 Unauthorized, and users whose roles do not match get 403
+// Forbidden. With no roles given, any authenticated user is let through.
+func RequireRolesMatching(next http.Handler, match RoleMatch, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		userInfo, ok := user.UserInfoFromContext(r.Context())
+		switch {
+		case !ok || userInfo.AuthenticationError != nil:
+			err = newAuthError(ErrNoToken, nil, "Request is not authenticated")
+		case match == MatchAll && !hasAllRoles(userInfo.Roles, roles):
+			err = newAuthError(ErrInsufficientRoles, nil, "User lacks some of the required roles %v", roles)
+		case match != MatchAll && !hasAnyRole(userInfo.Roles, roles):
+			err = newAuthError(ErrInsufficientRoles, nil, "User has none of the required roles %v", roles)
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", Challenge(err))
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasAnyRole reports whether roles contains one of requiredRoles, or
+// whether no roles are required
+func hasAnyRole(roles []string, requiredRoles []string) bool {
+	if len(requiredRoles) == 0 {
+		return true
+	}
+	for _, requiredRole := range requiredRoles {
+		for _, role := range roles {
+			if role == requiredRole {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAllRoles reports whether roles contains every one of requiredRoles
+func hasAllRoles(roles []string, requiredRoles []string) bool {
+	for _, requiredRole := range requiredRoles {
+		if !hasAnyRole(roles, []string{requiredRole}) {
+			return false
+		}
+	}
+	return true
+}
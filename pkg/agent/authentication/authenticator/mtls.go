@@ -0,0 +1,53 @@
+package authenticator
+
+import (
+	"net/http"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// MTLSAuthenticator authenticates callers by the SPIFFE ID in the URI SAN
+// of their X.509-SVID, presented as client certificate. The certificate
+// must have been verified by the TLS server, i.e. a client CA configured.
+type MTLSAuthenticator struct {
+	roleMappings []SPIFFEIDRoleMapping
+}
+
+// NewMTLSAuthenticator returns an authenticator granting roles by the
+// SPIFFE ID of the client certificate; the roles of all matching mappings
+// are combined
+func NewMTLSAuthenticator(roleMappings []SPIFFEIDRoleMapping) (*MTLSAuthenticator, error) {
+	if err := validateSPIFFEIDPatterns(roleMappings); err != nil {
+		return nil, err
+	}
+	return &MTLSAuthenticator{
+		roleMappings: roleMappings,
+	}, nil
+}
+
+func (a *MTLSAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	// VerifiedChains is only set once the server verified the client certificate
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return wrapAuthenticationError(newAuthError(ErrNoToken, nil, "Request carries no verified client certificate"))
+	}
+
+	id, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return wrapAuthenticationError(newAuthError(ErrInvalidToken, err, "Client certificate is no X.509-SVID: %v", err))
+	}
+
+	roles := spiffeIDRoles(a.roleMappings, id.String())
+	if len(roles) == 0 {
+		return wrapAuthenticationError(newAuthError(ErrInsufficientRoles, nil, "SPIFFE ID %s has no Tornjak role mapping", id))
+	}
+	return &user.UserInfo{
+		Roles:   roles,
+		Subject: id.String(),
+	}
+}
+
+func (a *MTLSAuthenticator) Close() error {
+	return nil
+}
@@ -0,0 +1,154 @@
+package authenticator
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// IssuerConfig identifies one issuer accepted by a MultiIssuerAuthenticator
+type IssuerConfig struct {
+	// IssuerURL is used for OIDC discovery
+	IssuerURL string
+	// Issuer is the expected iss claim of tokens, defaults to IssuerURL
+	Issuer string
+	// Audiences lists accepted aud values; empty skips the audience check
+	Audiences []string
+}
+
+// MultiIssuerAuthenticator accepts tokens from several issuers, for example
+// several Keycloak realms. The unverified iss claim of a token selects the
+// authenticator, and so the JWKS, that verifies it.
+type MultiIssuerAuthenticator struct {
+	issuers      map[string]*KeycloakAuthenticator
+	cookieName   string
+	formField    string
+	tokenQuery   tokenQuery
+	tokenHeader  string
+	tokenSchemes []string
+	metrics      *Metrics
+	auditSink    AuditSink
+	decrypter    *tokenDecrypter
+}
+
+// NewMultiIssuerAuthenticator performs OIDC discovery for each issuer. All
+// settings but the issuer and audiences are shared and taken from config.
+func NewMultiIssuerAuthenticator(ctx context.Context, httpjwks bool, config KeycloakConfig, issuers []IssuerConfig) (*MultiIssuerAuthenticator, error) {
+	a := &MultiIssuerAuthenticator{
+		issuers:      make(map[string]*KeycloakAuthenticator, len(issuers)),
+		cookieName:   config.TokenCookieName,
+		formField:    config.TokenFormField,
+		tokenQuery:   tokenQuery{parameter: config.TokenQueryParameter, paths: config.TokenQueryPaths},
+		tokenHeader:  config.TokenHeader,
+		tokenSchemes: config.TokenSchemes,
+		metrics:      config.Metrics,
+		auditSink:    config.AuditSink,
+		decrypter:    newTokenDecrypter(config),
+	}
+	for _, issuer := range issuers {
+		issuerConfig := config
+		issuerConfig.IssuerURL = issuer.IssuerURL
+		issuerConfig.Issuer = issuer.Issuer
+		issuerConfig.Audiences = issuer.Audiences
+		// the sink is closed once, with a
+		if config.AuditSink != nil {
+			issuerConfig.AuditSink = sharedAuditSink{config.AuditSink}
+		}
+
+		authenticator, err := NewKeycloakAuthenticator(ctx, httpjwks, issuerConfig)
+		if err != nil {
+			a.closeIssuers()
+			return nil, err
+		}
+		if _, ok := a.issuers[authenticator.Issuer()]; ok {
+			authenticator.Close()
+			a.closeIssuers()
+			return nil, errors.Errorf("Issuer %q is configured more than once", authenticator.Issuer())
+		}
+		a.issuers[authenticator.Issuer()] = authenticator
+	}
+	return a, nil
+}
+
+func (a *MultiIssuerAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	userInfo, _ := a.AuthenticateRequestContext(r.Context(), r)
+	return userInfo
+}
+
+// AuthenticateRequestContext authenticates r like AuthenticateRequest,
+// with the outbound calls of the validation bound to ctx
+func (a *MultiIssuerAuthenticator) AuthenticateRequestContext(ctx context.Context, r *http.Request) (*user.UserInfo, error) {
+	userInfo := a.authenticateRequest(ctx, r)
+	return userInfo, userInfo.AuthenticationError
+}
+
+func (a *MultiIssuerAuthenticator) authenticateRequest(ctx context.Context, r *http.Request) *user.UserInfo {
+	token, err := requestToken(r, a.cookieName, a.formField, a.tokenQuery, "", a.tokenHeader, a.tokenSchemes)
+	if err != nil {
+		return a.fail(err, r)
+	}
+
+	// the signature is verified, and an encrypted token decrypted again, by
+	// the authenticator of the issuer
+	signed, err := a.decrypter.decrypt(token)
+	if err != nil {
+		return a.fail(err, r)
+	}
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(signed, claims); err != nil {
+		err = newAuthError(ErrInvalidToken, err, "Error parsing token :%s", err.Error())
+		return a.fail(err, r)
+	}
+	authenticator, ok := a.issuers[claims.Issuer]
+	if !ok {
+		err := newAuthError(ErrInvalidToken, jwt.ErrTokenInvalidIssuer, "Token issuer %q matches none of the configured issuers", claims.Issuer)
+		return a.fail(err, r)
+	}
+	return authenticator.authenticateToken(ctx, token, r)
+}
+
+// fail records err, rejecting r before it reached the authenticator of an
+// issuer, and wraps it in a UserInfo
+func (a *MultiIssuerAuthenticator) fail(err error, r *http.Request) *user.UserInfo {
+	a.metrics.observeAuthentication(err)
+	userInfo := wrapAuthenticationError(err)
+	recordAuthEvent(a.auditSink, time.Now(), userInfo, r)
+	return userInfo
+}
+
+// SetRoleMappings replaces the role mappings of every issuer, see
+// KeycloakAuthenticator.SetRoleMappings. It is safe for concurrent use.
+func (a *MultiIssuerAuthenticator) SetRoleMappings(roleMappings map[string]string) {
+	for _, authenticator := range a.issuers {
+		authenticator.SetRoleMappings(roleMappings)
+	}
+}
+
+// RefreshJWKS fetches the JWKS of every issuer right away, see
+// KeycloakAuthenticator.RefreshJWKS
+func (a *MultiIssuerAuthenticator) RefreshJWKS(ctx context.Context) error {
+	for issuer, authenticator := range a.issuers {
+		if err := authenticator.RefreshJWKS(ctx); err != nil {
+			return errors.Errorf("Issuer %s: %v", issuer, err)
+		}
+	}
+	return nil
+}
+
+func (a *MultiIssuerAuthenticator) Close() error {
+	a.closeIssuers()
+	return closeAuditSink(a.auditSink)
+}
+
+// closeIssuers closes the authenticators of the issuers, which share the
+// audit sink of a without closing it
+func (a *MultiIssuerAuthenticator) closeIssuers() {
+	for _, authenticator := range a.issuers {
+		authenticator.Close()
+	}
+}
@@ -0,0 +1,80 @@
+package authenticator
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// networkAllowlist rejects requests from outside the allowed networks, for
+// all users or only those holding one of the restricted roles
+type networkAllowlist struct {
+	networks []*net.IPNet
+	// number of proxies in front of the server appending to X-Forwarded-For
+	trustedProxies int
+	roles          []string
+}
+
+// parseNetworks parses CIDRs such as "10.0.0.0/8" or "2001:db8::/32"
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Errorf("invalid allowed network %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// check returns an error if userInfo is restricted and r does not
+// originate from an allowed network
+func (l *networkAllowlist) check(r *http.Request, userInfo *user.UserInfo) error {
+	if len(l.roles) > 0 && !hasAnyRole(userInfo.Roles, l.roles) {
+		return nil
+	}
+	ip, err := clientIP(r, l.trustedProxies)
+	if err != nil {
+		return newAuthError(ErrUntrustedNetwork, err, "Could not determine the client address: %v", err)
+	}
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return newAuthError(ErrUntrustedNetwork, nil, "Requests from %s are not allowed", ip)
+}
+
+// clientIP returns the address of the client of r. With trusted proxies,
+// it is taken from X-Forwarded-For, skipping the addresses appended by
+// the proxies; requests that passed fewer proxies are refused, as their
+// X-Forwarded-For may be set by the client.
+func clientIP(r *http.Request, trustedProxies int) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	chain := []string{}
+	if trustedProxies > 0 {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(header, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+	}
+	chain = append(chain, host)
+	if len(chain) <= trustedProxies {
+		return nil, errors.Errorf("expected %d proxies in X-Forwarded-For, got %d", trustedProxies, len(chain)-1)
+	}
+	addr := chain[len(chain)-1-trustedProxies]
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.Errorf("invalid address %q", addr)
+	}
+	return ip, nil
+}
@@ -0,0 +1,22 @@
+package authenticator
+
+import (
+	"net/http"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// NoopAuthenticator is used when no Authenticator is configured.
+// It passes no user information to the authorization layer.
+type NoopAuthenticator struct{}
+
+func NewNoopAuthenticator() *NoopAuthenticator {
+	return &NoopAuthenticator{}
+}
+func (a *NoopAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	return nil
+}
+
+func (a *NoopAuthenticator) Close() error {
+	return nil
+}
@@ -6,11 +6,34 @@ import (
 	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
 )
 
-type NullAuthenticator struct{}
+// default roles granted by the NullAuthenticator
+var defaultNullAuthenticatorRoles = []string{"admin"}
 
-func NewNullAuthenticator() *NullAuthenticator {
-	return &NullAuthenticator{}
+// NullAuthenticator authenticates every request with a fixed set of roles.
+// It disables authentication and is meant for local development only.
+type NullAuthenticator struct {
+	roles []string
 }
+
+// NewNullAuthenticator returns an authenticator granting the given roles to
+// every request, or the admin role if none are given. A warning is logged
+// to logger, or stdout if nil.
+func NewNullAuthenticator(roles []string, logger Logger) *NullAuthenticator {
+	if len(roles) == 0 {
+		roles = defaultNullAuthenticatorRoles
+	}
+	loggerOrDefault(logger).Warnf("Null Authenticator configured - authentication is disabled and every request is granted roles %v", roles)
+	return &NullAuthenticator{
+		roles: roles,
+	}
+}
+
 func (a *NullAuthenticator) AuthenticateRequest(r *http.Request) *user.UserInfo {
+	return &user.UserInfo{
+		Roles: append([]string{}, a.roles...),
+	}
+}
+
+func (a *NullAuthenticator) Close() error {
 	return nil
 }
@@ -0,0 +1,88 @@
+package authenticator
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// PublicKeyPEM is a PEM encoded RSA, ECDSA or Ed25519 public key
+type PublicKeyPEM struct {
+	// KID is matched against the kid header of tokens; a key without a KID
+	// verifies tokens whose kid matches no other key
+	KID string
+	PEM []byte
+}
+
+// NewKeycloakAuthenticatorWithPublicKeys returns an authenticator verifying
+// tokens with the given public keys, for issuers publishing no JWKS. No OIDC
+// discovery is performed.
+func NewKeycloakAuthenticatorWithPublicKeys(publicKeys []PublicKeyPEM, config KeycloakConfig) (*KeycloakAuthenticator, error) {
+	if len(publicKeys) == 0 {
+		return nil, errors.New("At least one public key is required")
+	}
+	allowedAlgs, err := resolveAllowedAlgorithms(config.AllowedAlgorithms, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false); err != nil {
+		return nil, err
+	}
+	keyFunc, err := publicKeysKeyfunc(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return newKeycloakAuthenticator(&keySource{keyFunc: asymmetricKeyfunc(keyFunc)}, allowedAlgs, config), nil
+}
+
+// publicKeysKeyfunc returns a keyfunc selecting the key by the kid header
+// of the token. Tokens without kid, or with a kid matching no key, are
+// verified with any of the keys without a KID; tokens without kid are also
+// tried against all keys if none lacks a KID.
+func publicKeysKeyfunc(publicKeys []PublicKeyPEM) (jwt.Keyfunc, error) {
+	byKID := map[string]jwt.VerificationKey{}
+	anyKID := []jwt.VerificationKey{}
+	all := []jwt.VerificationKey{}
+	for i, publicKey := range publicKeys {
+		key, err := parsePublicKeyPEM(publicKey.PEM)
+		if err != nil {
+			return nil, errors.Errorf("Could not parse public key %d (kid %q): %v", i+1, publicKey.KID, err)
+		}
+		all = append(all, key)
+		if publicKey.KID == "" {
+			anyKID = append(anyKID, key)
+			continue
+		}
+		if _, ok := byKID[publicKey.KID]; ok {
+			return nil, errors.Errorf("Public key kid %q is configured more than once", publicKey.KID)
+		}
+		byKID[publicKey.KID] = key
+	}
+
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := byKID[kid]; ok && kid != "" {
+			return key, nil
+		}
+		if len(anyKID) > 0 {
+			return jwt.VerificationKeySet{Keys: anyKID}, nil
+		}
+		if kid == "" {
+			return jwt.VerificationKeySet{Keys: all}, nil
+		}
+		return nil, errors.Errorf("No public key with kid %q", kid)
+	}, nil
+}
+
+// parsePublicKeyPEM parses a PEM encoded RSA, ECDSA or Ed25519 public key
+func parsePublicKeyPEM(pem []byte) (jwt.VerificationKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("not a PEM encoded RSA, ECDSA or Ed25519 public key")
+}
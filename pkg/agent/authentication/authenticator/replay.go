@@ -0,0 +1,79 @@
+package authenticator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// maximum number of token IDs kept in the replay cache
+const replayCacheMaxEntries = 10000
+
+// errTokenReplayed is the cause of errors rejecting a single-use token
+// presented again
+var errTokenReplayed = errors.New("token replayed")
+
+// replayCache remembers the jti of single-use tokens until they expire.
+// It is safe for concurrent use.
+type replayCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	now     func() time.Time // clock the expiries are checked against
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// use records the first use of jti, returning an error if it was used
+// before or the cache is full
+func (c *replayCache) use(jti string, expiry time.Time) error {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if previous, ok := c.entries[jti]; ok && now.Before(previous) {
+		return newAuthError(ErrInvalidToken, errTokenReplayed, "Single-use token %s was already used", jti)
+	}
+	if len(c.entries) >= replayCacheMaxEntries {
+		c.removeExpired(now)
+		if len(c.entries) >= replayCacheMaxEntries { // still full, fail closed
+			return newAuthError(ErrInvalidToken, nil, "Too many single-use tokens in use, please retry later")
+		}
+	}
+	c.entries[jti] = expiry
+	return nil
+}
+
+// removeExpired drops expired entries, must be called with c.mu held
+func (c *replayCache) removeExpired(now time.Time) {
+	for jti, expiry := range c.entries {
+		if !now.Before(expiry) {
+			delete(c.entries, jti)
+		}
+	}
+}
+
+// singleUse reports whether userInfo holds one of the roles whose tokens
+// may only be used once
+func (a *KeycloakAuthenticator) singleUse(userInfo *user.UserInfo) bool {
+	return a.replayCache != nil && userInfo.AuthenticationError == nil && len(userInfo.Roles) > 0 && hasAnyRole(userInfo.Roles, a.singleUseRoles)
+}
+
+// checkReplay rejects single-use tokens without jti or exp, and those
+// whose jti was seen before
+func (a *KeycloakAuthenticator) checkReplay(userInfo *user.UserInfo, claims *KeycloakClaim) error {
+	if !a.singleUse(userInfo) {
+		return nil
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return newAuthError(ErrInvalidToken, nil, "Tokens granting roles %v must carry jti and exp claims", a.singleUseRoles)
+	}
+	return a.replayCache.use(claims.ID, claims.ExpiresAt.Time.Add(a.leeway))
+}
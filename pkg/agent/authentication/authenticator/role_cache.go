@@ -0,0 +1,180 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of subjects kept in the role cache
+const roleCacheMaxEntries = 10000
+
+type roleCacheEntry struct {
+	roles  []string
+	expiry time.Time
+}
+
+// roleCache keeps the Tornjak roles resolved for a subject for a fixed
+// time, so that new tokens of the same user reuse them. It is safe for
+// concurrent use.
+type roleCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]roleCacheEntry
+	// generation is bumped by clear, so that roles resolved before are not
+	// put afterwards
+	generation uint64
+}
+
+func newRoleCache(ttl time.Duration) *roleCache {
+	return &roleCache{
+		ttl:     ttl,
+		entries: make(map[string]roleCacheEntry),
+	}
+}
+
+// get returns the roles cached for subject, if not yet expired
+func (c *roleCache) get(subject string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[subject]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expiry) {
+		delete(c.entries, subject)
+		return nil, false
+	}
+	return append([]string(nil), entry.roles...), true
+}
+
+// currentGeneration returns the generation to pass to put for roles about
+// to be resolved
+func (c *roleCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches the roles of subject for the TTL of the cache, unless the
+// cache was cleared since generation was read: the roles may then have
+// been resolved with replaced role mappings
+func (c *roleCache) put(subject string, roles []string, generation uint64) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= roleCacheMaxEntries {
+		c.removeExpired(now)
+		if len(c.entries) >= roleCacheMaxEntries { // still full, skip caching
+			return
+		}
+	}
+	c.entries[subject] = roleCacheEntry{
+		roles:  append([]string(nil), roles...),
+		expiry: now.Add(c.ttl),
+	}
+}
+
+// remove drops the roles of subject
+func (c *roleCache) remove(subject string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, subject)
+}
+
+// removeSubject drops the roles cached for every token of subject, keyed
+// by roleCacheKey
+func (c *roleCache) removeSubject(tenant string, subject string) {
+	prefix := roleCacheSubjectKey(tenant, subject) + "\x00"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear drops all entries
+func (c *roleCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]roleCacheEntry)
+	c.generation++
+}
+
+// removeExpired drops expired entries, must be called with c.mu held
+func (c *roleCache) removeExpired(now time.Time) {
+	for subject, entry := range c.entries {
+		if !now.Before(entry.expiry) {
+			delete(c.entries, subject)
+		}
+	}
+}
+
+// roleCacheSubjectKey identifies subject in the role cache, as the same
+// subject may hold different roles per tenant
+func roleCacheSubjectKey(tenant string, subject string) string {
+	return tenant + "\x00" + subject
+}
+
+// roleCacheKey returns the key of the roles resolved for a token of
+// subject: the roles, scopes and groups of the token are grants of that
+// token rather than of its subject, so they are hashed into the key, so
+// that a token with fewer of them never reuses the roles of a broader one
+func roleCacheKey(tenant string, subject string, tokenRoles []string, scopes []string, groups []string) string {
+	hash := sha256.New()
+	for _, values := range [][]string{tokenRoles, scopes, groups} {
+		sorted := append([]string(nil), values...)
+		sort.Strings(sorted)
+		for _, value := range sorted {
+			hash.Write([]byte(value))
+			hash.Write([]byte{0})
+		}
+		hash.Write([]byte{1})
+	}
+	return roleCacheSubjectKey(tenant, subject) + "\x00" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// resolveRoles returns the Tornjak roles of the token, translated with the
+// role mappings of its tenant and including those from the userinfo
+// endpoint if enabled. Those resolved for its subject within the TTL of
+// the role cache, if enabled, are reused for tokens with the same roles,
+// scopes and groups.
+func (a *KeycloakAuthenticator) resolveRoles(ctx context.Context, token string, claims *KeycloakClaim, tenant string, tenantRoleMappings map[string]string) []string {
+	tokenRoles := a.tokenRoles(claims)
+	useCache := a.roleCache != nil && claims.Subject != ""
+	var cacheKey string
+	var generation uint64
+	if useCache {
+		generation = a.roleCache.currentGeneration()
+		cacheKey = roleCacheKey(tenant, claims.Subject, tokenRoles, strings.Fields(claims.Scope), claims.StringsAt(a.groupsClaim))
+		if roles, ok := a.roleCache.get(cacheKey); ok {
+			return roles
+		}
+	}
+	userInfoRoles, complete := a.userInfoRoles(ctx, token, claims)
+	if len(userInfoRoles) > 0 {
+		tokenRoles = dedupeRoles(append(tokenRoles, userInfoRoles...))
+	}
+	roles := a.translateRoles(tokenRoles, tenantRoleMappings)
+	if scopeRoles := a.scopeRoles(claims); len(scopeRoles) > 0 {
+		roles = dedupeRoles(append(roles, scopeRoles...))
+	}
+	if groupRoles := a.groupRoles(claims); len(groupRoles) > 0 {
+		roles = dedupeRoles(append(roles, groupRoles...))
+	}
+	// roles lacking those of an unreachable userinfo endpoint are not reused
+	if useCache && complete {
+		a.roleCache.put(cacheKey, roles, generation)
+	}
+	return roles
+}
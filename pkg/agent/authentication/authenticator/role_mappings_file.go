@@ -0,0 +1,101 @@
+package authenticator
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// LoadRoleMappingsFile reads role mappings from a JSON or YAML file holding
+// a single object from token roles to Tornjak roles, such as
+//
+//	tornjak-admin-realm-role: admin
+//	tornjak-viewer-realm-role: viewer
+//
+// An empty mapping is rejected, as it would pass all token roles through.
+func LoadRoleMappingsFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("Could not read role mappings file %s: %v", path, err)
+	}
+	roleMappings := map[string]string{}
+	if err := yaml.UnmarshalStrict(raw, &roleMappings); err != nil {
+		return nil, errors.Errorf("Could not parse role mappings file %s: %v", path, err)
+	}
+	if len(roleMappings) == 0 {
+		return nil, errors.Errorf("Role mappings file %s holds no role mappings", path)
+	}
+	for role, tornjakRole := range roleMappings {
+		if role == "" || tornjakRole == "" {
+			return nil, errors.Errorf("Role mappings file %s maps %q to %q, roles must not be empty", path, role, tornjakRole)
+		}
+	}
+	return roleMappings, nil
+}
+
+// WatchRoleMappingsFile sets the role mappings to those read from a file
+// and reloads them whenever the file changes or the process receives
+// SIGHUP, until Close. A file failing to load on reload is logged and the
+// previous mappings are kept.
+func (a *KeycloakAuthenticator) WatchRoleMappingsFile(path string) error {
+	roleMappings, err := LoadRoleMappingsFile(path)
+	if err != nil {
+		return err
+	}
+	a.SetRoleMappings(roleMappings)
+	a.logger.Debugf("Loaded %d role mappings from %s", len(roleMappings), path)
+
+	// the directory is watched to follow files replaced by renames
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Errorf("Could not watch role mappings file %s: %v", path, err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return errors.Errorf("Could not watch role mappings file %s: %v", path, err)
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	a.runInBackground(func(ctx context.Context) {
+		defer watcher.Close()
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				a.logger.Errorf("Error watching role mappings file %s: %v", path, err)
+				continue
+			case <-watcher.Events:
+			case <-hangup:
+			}
+
+			roleMappings, err := LoadRoleMappingsFile(path)
+			if err != nil {
+				a.logger.Errorf("Could not reload role mappings, keeping previous mappings: %v", err)
+				continue
+			}
+			a.SetRoleMappings(roleMappings)
+			a.logger.Debugf("Reloaded %d role mappings from %s", len(roleMappings), path)
+		}
+	})
+	return nil
+}
+
+// WatchRoleMappingsFile watches the role mappings file for every issuer,
+// see KeycloakAuthenticator.WatchRoleMappingsFile
+func (a *MultiIssuerAuthenticator) WatchRoleMappingsFile(path string) error {
+	for _, authenticator := range a.issuers {
+		if err := authenticator.WatchRoleMappingsFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
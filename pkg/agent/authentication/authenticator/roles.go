@@ -0,0 +1,218 @@
+package authenticator
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RolePatternMapping maps every token role matching a glob pattern, as
+// understood by path.Match, to a Tornjak role
+type RolePatternMapping struct {
+	Pattern string
+	Role    string
+}
+
+// tokenRoles collects the roles found in the token claims: the roles at the
+// configured roles claim, combined with the client roles of the configured client
+func (a *KeycloakAuthenticator) tokenRoles(claims *KeycloakClaim) []string {
+	roles := claims.StringsAt(a.rolesClaim)
+	if a.rolesClientID != "" {
+		if clientAccess, ok := claims.ResourceAccess[a.rolesClientID]; ok {
+			roles = dedupeRoles(append(roles, clientAccess.Roles...))
+		}
+	}
+	return roles
+}
+
+// scopeRoles maps the scopes of the token to Tornjak roles using the
+// configured scope mappings
+func (a *KeycloakAuthenticator) scopeRoles(claims *KeycloakClaim) []string {
+	roles := []string{}
+	for _, scope := range strings.Fields(claims.Scope) {
+		if tornjakRole, ok := a.scopeMappings[scope]; ok {
+			roles = append(roles, tornjakRole)
+		}
+	}
+	return roles
+}
+
+// dedupeRoles removes duplicate roles, keeping the first occurrence of each
+func dedupeRoles(roles []string) []string {
+	seen := make(map[string]struct{}, len(roles))
+	deduped := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if _, ok := seen[role]; ok {
+			continue
+		}
+		seen[role] = struct{}{}
+		deduped = append(deduped, role)
+	}
+	return deduped
+}
+
+// TranslateToTornjakRoles maps roles found in the token to Tornjak roles
+// using the configured role mappings. Roles are first stripped of the role
+// prefix, and composite roles replaced by the roles they expand to. An exact
+// mapping takes precedence, otherwise the first matching role pattern, in
+// configured order, is used.
+// Incoming roles without a mapping are dropped, and the result holds each
+// role once, in the order first translated to, even if several incoming
+// roles map to it. If no role mappings are configured, roles are passed
+// through, also without duplicates.
+func (a *KeycloakAuthenticator) TranslateToTornjakRoles(roles []string) []string {
+	return a.translateRoles(roles, nil)
+}
+
+// translateRoles translates roles like TranslateToTornjakRoles, with the
+// role mappings of a tenant taking precedence over the configured ones
+func (a *KeycloakAuthenticator) translateRoles(roles []string, tenantRoleMappings map[string]string) []string {
+	roles = a.expandCompositeRoles(a.stripRolePrefix(roles))
+	roleMappings := a.RoleMappings()
+	if len(roleMappings) == 0 && len(tenantRoleMappings) == 0 && len(a.rolePatterns) == 0 {
+		return roles
+	}
+	tornjakRoles := []string{}
+	for _, role := range roles {
+		if tornjakRole, ok := tenantRoleMappings[role]; ok {
+			tornjakRoles = append(tornjakRoles, tornjakRole)
+			continue
+		}
+		if tornjakRole, _, ok := a.mapRole(roleMappings, role); ok {
+			tornjakRoles = append(tornjakRoles, tornjakRole)
+			continue
+		}
+		a.metrics.observeUnmappedRole()
+		if a.unmappedRoles.firstSeen(role) {
+			a.logger.Warnf("Token role %q has no Tornjak role mapping and is dropped", role)
+		}
+	}
+	return dedupeRoles(tornjakRoles)
+}
+
+// stripRolePrefix removes the role prefix from roles carrying it and drops
+// all other roles
+func (a *KeycloakAuthenticator) stripRolePrefix(roles []string) []string {
+	if a.rolePrefix == "" {
+		return roles
+	}
+	stripped := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if name, ok := strings.CutPrefix(role, a.rolePrefix); ok && name != "" {
+			stripped = append(stripped, name)
+		}
+	}
+	return stripped
+}
+
+// expandCompositeRoles replaces each composite role by the roles it expands
+// to, one level deep, removing duplicates
+func (a *KeycloakAuthenticator) expandCompositeRoles(roles []string) []string {
+	if len(a.composites) == 0 {
+		return dedupeRoles(roles)
+	}
+	expanded := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if composite, ok := a.composites[role]; ok {
+			expanded = append(expanded, composite...)
+			continue
+		}
+		expanded = append(expanded, role)
+	}
+	return dedupeRoles(expanded)
+}
+
+// maximum number of distinct unmapped roles remembered for logging
+const unmappedRolesMaxEntries = 1000
+
+// unmappedRoleSet remembers unmapped roles so that each is logged once
+type unmappedRoleSet struct {
+	mu    sync.Mutex
+	roles map[string]struct{}
+}
+
+// firstSeen records role and reports whether it had not been seen before.
+// Once the set is full, no role is reported, bounding log volume.
+func (s *unmappedRoleSet) firstSeen(role string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roles[role]; ok || len(s.roles) >= unmappedRolesMaxEntries {
+		return false
+	}
+	if s.roles == nil {
+		s.roles = map[string]struct{}{}
+	}
+	s.roles[role] = struct{}{}
+	return true
+}
+
+// mapRole returns the Tornjak role that role maps to, along with the role
+// pattern matched, which is empty for an exact mapping
+func (a *KeycloakAuthenticator) mapRole(roleMappings map[string]string, role string) (string, string, bool) {
+	if tornjakRole, ok := roleMappings[role]; ok {
+		return tornjakRole, "", true
+	}
+	for _, mapping := range a.rolePatterns {
+		// patterns are validated at construction
+		if matched, _ := path.Match(mapping.Pattern, role); matched {
+			return mapping.Role, mapping.Pattern, true
+		}
+	}
+	return "", "", false
+}
+
+// RoleMappings returns the role mappings currently in use. The returned
+// map must not be modified.
+func (a *KeycloakAuthenticator) RoleMappings() map[string]string {
+	return *a.roleMappings.Load()
+}
+
+// SetRoleMappings replaces the role mappings, for example to recognize a
+// new role without a restart. It is safe to call concurrently with request
+// authentication: each request translates its roles with either the old or
+// the new mappings. Cached results are dropped so that the new mappings
+// apply to every following request.
+func (a *KeycloakAuthenticator) SetRoleMappings(roleMappings map[string]string) {
+	copied := make(map[string]string, len(roleMappings))
+	for role, tornjakRole := range roleMappings {
+		copied[role] = tornjakRole
+	}
+	a.roleMappings.Store(&copied)
+	if a.tokenCache != nil {
+		a.tokenCache.clear()
+	}
+	if a.roleCache != nil {
+		a.roleCache.clear()
+	}
+}
+
+// KnownTornjakRoles returns the sorted, distinct Tornjak roles the configured
+// role mappings, role patterns, scope and group mappings translate to. Roles passed
+// through unchanged, when no role mappings are configured, are not known.
+func (a *KeycloakAuthenticator) KnownTornjakRoles() []string {
+	seen := map[string]struct{}{}
+	for _, tornjakRole := range a.RoleMappings() {
+		seen[tornjakRole] = struct{}{}
+	}
+	for _, roleMappings := range a.tenantRoleMappings {
+		for _, tornjakRole := range roleMappings {
+			seen[tornjakRole] = struct{}{}
+		}
+	}
+	for _, mapping := range a.rolePatterns {
+		seen[mapping.Role] = struct{}{}
+	}
+	for _, tornjakRole := range a.scopeMappings {
+		seen[tornjakRole] = struct{}{}
+	}
+	for _, mapping := range a.groupMappings {
+		seen[mapping.Role] = struct{}{}
+	}
+	roles := make([]string, 0, len(seen))
+	for role := range seen {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
@@ -0,0 +1,34 @@
+package authenticator
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// SPIFFEIDRoleMapping grants Roles to callers whose SPIFFE ID matches
+// Pattern, a path.Match glob such as "spiffe://example.org/ns/*/sa/admin"
+type SPIFFEIDRoleMapping struct {
+	Pattern string
+	Roles   []string
+}
+
+func validateSPIFFEIDPatterns(mappings []SPIFFEIDRoleMapping) error {
+	for _, mapping := range mappings {
+		if _, err := path.Match(mapping.Pattern, ""); err != nil {
+			return errors.Errorf("Invalid SPIFFE ID pattern %q: %v", mapping.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// spiffeIDRoles returns the distinct roles of all mappings matching id
+func spiffeIDRoles(mappings []SPIFFEIDRoleMapping, id string) []string {
+	roles := []string{}
+	for _, mapping := range mappings {
+		if matched, _ := path.Match(mapping.Pattern, id); matched {
+			roles = append(roles, mapping.Roles...)
+		}
+	}
+	return dedupeRoles(roles)
+}
@@ -0,0 +1,19 @@
+package authenticator
+
+// verifyTenant returns the tenant of the token, found at the tenant claim,
+// and the role mappings of that tenant. If a tenant claim is configured,
+// tokens without a tenant, or whose tenant is not configured, are rejected.
+func (a *KeycloakAuthenticator) verifyTenant(claims *KeycloakClaim) (string, map[string]string, error) {
+	if a.tenantClaim == "" {
+		return "", nil, nil
+	}
+	tenants := claims.StringsAt(a.tenantClaim)
+	if len(tenants) != 1 || tenants[0] == "" {
+		return "", nil, newAuthError(ErrInvalidToken, nil, "Token must carry exactly one tenant at claim %s", a.tenantClaim)
+	}
+	roleMappings, ok := a.tenantRoleMappings[tenants[0]]
+	if !ok {
+		return "", nil, newAuthError(ErrInvalidToken, nil, "Token tenant %q is not served", tenants[0])
+	}
+	return tenants[0], roleMappings, nil
+}
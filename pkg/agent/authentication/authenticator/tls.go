@@ -0,0 +1,89 @@
+package authenticator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig configures TLS for OIDC discovery, JWKS fetches and token
+// introspection, for example to trust an issuer behind an internal CA
+type TLSConfig struct {
+	// CAFile is a PEM file of the CA certificates to trust
+	CAFile string
+	// CAPEM holds PEM encoded CA certificates to trust, in addition to CAFile
+	CAPEM []byte
+	// MinVersion is the minimum TLS version, e.g. tls.VersionTLS12;
+	// zero keeps the crypto/tls default
+	MinVersion uint16
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CAFile != "" || len(c.CAPEM) > 0 || c.MinVersion != 0
+}
+
+// tlsConfig builds the tls.Config. If CA certificates are given, only
+// they are trusted, otherwise the system trust store is used.
+func (c TLSConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: c.MinVersion}
+	if c.CAFile == "" && len(c.CAPEM) == 0 {
+		return tlsConfig, nil
+	}
+
+	pool := x509.NewCertPool()
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Errorf("Could not read CA file %s: %v", c.CAFile, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("No valid PEM certificates found in CA file %s", c.CAFile)
+		}
+	}
+	if len(c.CAPEM) > 0 && !pool.AppendCertsFromPEM(c.CAPEM) {
+		return nil, errors.New("No valid PEM certificates found in CA PEM")
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// httpClient returns the client used for discovery and JWKS fetches: the
+// configured HTTPClient, or one applying the TLS and transport
+// configuration
+func (c KeycloakConfig) httpClient() (*http.Client, error) {
+	if c.HTTPClient != nil && c.Transport.enabled() {
+		return nil, errors.New("HTTPClient and Transport cannot both be configured")
+	}
+	if c.HTTPClient != nil {
+		return newHTTPClient(c.HTTPClient, c.TLS)
+	}
+	var tlsConfig *tls.Config
+	if c.TLS.enabled() {
+		var err error
+		if tlsConfig, err = c.TLS.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Client{Transport: c.Transport.roundTripper(tlsConfig)}, nil
+}
+
+// newHTTPClient returns client, or if TLS options are given a new client
+// applying them. Nil is returned if neither is given.
+func newHTTPClient(client *http.Client, options TLSConfig) (*http.Client, error) {
+	if !options.enabled() {
+		return client, nil
+	}
+	if client != nil {
+		return nil, errors.New("HTTPClient and TLS cannot both be configured")
+	}
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
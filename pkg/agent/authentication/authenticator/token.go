@@ -0,0 +1,209 @@
+package authenticator
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// scheme of the Authorization header accepted by default
+const defaultTokenScheme = "Bearer"
+
+// maximum number of bytes of a request body read looking for the token
+// form field; a field further into the body is not found
+const maxTokenFormSize = 1 << 20
+
+// getToken returns the token of the header, defaulting to Authorization.
+// The scheme is matched case-insensitively, as required by RFC 7235,
+// against schemes, defaulting to Bearer only. A header other than
+// Authorization may also hold the raw token, without a scheme, as
+// forwarded by authenticating proxies.
+func getToken(r *http.Request, redirectURL string, header string, schemes []string) (string, error) {
+	if header == "" {
+		header = "Authorization"
+	}
+	// Authorization parameter from HTTP header
+	auth_header := r.Header.Get(header)
+	if auth_header == "" {
+		if redirectURL == "" {
+			return "", newAuthError(ErrNoToken, nil, "%s header missing", header)
+		}
+		return "", newAuthError(ErrNoToken, nil, "%s header missing. Please obtain access token here: %s", header, redirectURL)
+	}
+
+	// get bearer token
+	auth_fields := strings.Fields(auth_header)
+	if len(auth_fields) == 1 && !strings.EqualFold(header, "Authorization") {
+		return auth_fields[0], nil
+	}
+	if len(auth_fields) != 2 || !isTokenScheme(auth_fields[0], schemes) {
+		return "", newAuthError(ErrInvalidToken, nil, "Expected bearer token, got %s", auth_header)
+	} else {
+		return auth_fields[1], nil
+	}
+
+}
+
+func isTokenScheme(scheme string, schemes []string) bool {
+	if len(schemes) == 0 {
+		return strings.EqualFold(scheme, defaultTokenScheme)
+	}
+	for _, s := range schemes {
+		if strings.EqualFold(scheme, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRequestToken returns the token of the request, read from the
+// Authorization header or, if the header is missing, from the configured
+// cookie, form field or query parameter
+func (a *KeycloakAuthenticator) getRequestToken(r *http.Request) (string, error) {
+	return requestToken(r, a.cookieName, a.formField, a.tokenQuery, a.keys.Load().jwksURL, a.tokenHeader, a.tokenSchemes)
+}
+
+func requestToken(r *http.Request, cookieName string, formField string, query tokenQuery, redirectURL string, header string, schemes []string) (string, error) {
+	if header == "" {
+		header = "Authorization"
+	}
+	if r.Header.Get(header) == "" {
+		if cookieName != "" {
+			if cookie, err := r.Cookie(cookieName); err == nil && cookie.Value != "" {
+				return cookie.Value, nil
+			}
+		}
+		if formField != "" {
+			if token := formToken(r, formField); token != "" {
+				return token, nil
+			}
+		}
+		if token := query.token(r); token != "" {
+			return token, nil
+		}
+	}
+	return getToken(r, redirectURL, header, schemes)
+}
+
+// tokenQuery reads the token from a query parameter, for the paths of
+// browser downloads that cannot set a header. Query parameters end up in
+// access logs, browser history and Referer headers, so this is only meant
+// for a few download endpoints used with short-lived tokens.
+type tokenQuery struct {
+	parameter string   // empty if tokens are never read from the query
+	paths     []string // path.Match patterns of the paths it is read for
+}
+
+// token returns the token in the query parameter of a GET or HEAD request
+// to one of the paths, or "" if there is none. The parameter is removed
+// from r, so that handlers downstream do not see, and log, the token.
+func (q tokenQuery) token(r *http.Request) string {
+	if q.parameter == "" || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if !q.matchesPath(r.URL.Path) {
+		return ""
+	}
+	values := r.URL.Query()
+	token := values.Get(q.parameter)
+	if token == "" {
+		return ""
+	}
+	values.Del(q.parameter)
+	r.URL.RawQuery = values.Encode()
+	if r.Form != nil {
+		r.Form.Del(q.parameter)
+	}
+	return token
+}
+
+func (q tokenQuery) matchesPath(requestPath string) bool {
+	for _, pattern := range q.paths {
+		// patterns are validated at construction
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// formToken returns the value of field in the URL encoded or multipart form
+// posted with r, or "" if there is none. Only the first maxTokenFormSize
+// bytes of the body are read, and they are put back, so that handlers
+// downstream still read the whole body.
+func formToken(r *http.Request, field string) string {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return ""
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	if r.PostForm != nil { // already parsed by a handler in front
+		return r.PostForm.Get(field)
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	// one byte past the limit tells a body cut short from one ending there
+	read := &bytes.Buffer{}
+	body := io.TeeReader(io.LimitReader(r.Body, maxTokenFormSize+1), read)
+	var token string
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		token = urlEncodedFormToken(body, field)
+	case "multipart/form-data":
+		token = multipartFormToken(multipart.NewReader(body, params["boundary"]), field)
+	default:
+		return ""
+	}
+	r.Body = &replayedBody{Reader: io.MultiReader(read, r.Body), Closer: r.Body}
+	return token
+}
+
+// urlEncodedFormToken returns the value of field in the form read from
+// body, or "" if the form exceeds maxTokenFormSize
+func urlEncodedFormToken(body io.Reader, field string) string {
+	data, err := io.ReadAll(body)
+	if err != nil || len(data) > maxTokenFormSize {
+		return ""
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return ""
+	}
+	return values.Get(field)
+}
+
+// multipartFormToken returns the value of the first part named field that
+// is not a file, reading no further than needed
+func multipartFormToken(form *multipart.Reader, field string) string {
+	for {
+		part, err := form.NextPart()
+		if err != nil {
+			return ""
+		}
+		if part.FormName() != field || part.FileName() != "" {
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(value))
+	}
+}
+
+// replayedBody is a request body whose start, read looking for the token,
+// is read again before the rest
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
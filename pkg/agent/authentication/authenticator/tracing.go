@@ -0,0 +1,35 @@
+package authenticator
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/spiffe/tornjak/pkg/agent/authentication/authenticator"
+
+// newTracer returns the tracer of the package from provider, or from the
+// global provider if nil
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// setSpanResult records the outcome of an authentication on span. Only the
+// failure reason is recorded, as error messages may quote the request's
+// Authorization header.
+func setSpanResult(span trace.Span, err error) {
+	if err == nil {
+		span.SetAttributes(attribute.String("tornjak.auth.result", "success"))
+		return
+	}
+	reason := failureReason(err)
+	span.SetAttributes(
+		attribute.String("tornjak.auth.result", "failure"),
+		attribute.String("tornjak.auth.failure_reason", reason),
+	)
+	span.SetStatus(codes.Error, reason)
+}
@@ -0,0 +1,72 @@
+package authenticator
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// defaults of the connection pool of the discovery and JWKS client. More
+// idle connections are kept per host than net/http does, as all requests go
+// to the IAM System, so that frequent JWKS refreshes reuse connections.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// TransportConfig tunes the connections of the client used for OIDC
+// discovery and fetching the JWKS. Keep-alives are always enabled.
+type TransportConfig struct {
+	// MaxIdleConns limits the idle connections kept across hosts,
+	// defaults to 100
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the idle connections kept per host,
+	// defaults to 10
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept, defaults to
+	// 90s
+	IdleConnTimeout time.Duration
+	// ForceHTTP2 makes every request use HTTP/2, failing against servers
+	// that do not negotiate it, instead of attempting HTTP/2 and falling
+	// back to HTTP/1.1. A single connection per host is then multiplexed,
+	// so MaxIdleConns and MaxIdleConnsPerHost do not apply. It requires
+	// https URLs.
+	ForceHTTP2 bool
+}
+
+func (c TransportConfig) enabled() bool {
+	return c.MaxIdleConns != 0 || c.MaxIdleConnsPerHost != 0 || c.IdleConnTimeout != 0 || c.ForceHTTP2
+}
+
+// roundTripper returns the transport with the connection settings, using
+// tlsConfig for https connections
+func (c TransportConfig) roundTripper(tlsConfig *tls.Config) http.RoundTripper {
+	idleConnTimeout := c.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+	if c.ForceHTTP2 {
+		return &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			IdleConnTimeout: idleConnTimeout,
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	transport.DisableKeepAlives = false
+	transport.MaxIdleConns = c.MaxIdleConns
+	if transport.MaxIdleConns == 0 {
+		transport.MaxIdleConns = defaultMaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = idleConnTimeout
+	return transport
+}
@@ -0,0 +1,78 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long the roles from the userinfo endpoint are cached per subject,
+// unless configured otherwise
+const defaultUserInfoCacheTTL = 5 * time.Minute
+
+// timeout of requests to the userinfo endpoint
+const userInfoTimeout = 10 * time.Second
+
+// maximum size of a userinfo response read
+const maxUserInfoResponseSize = 1 << 20
+
+// userInfoRoles returns the roles the userinfo endpoint of the issuer
+// returns for the subject of the token, cached per subject. If the
+// endpoint cannot be queried, the error is logged and no roles are
+// returned, so that the token roles alone apply; ok is then false.
+func (a *KeycloakAuthenticator) userInfoRoles(ctx context.Context, token string, claims *KeycloakClaim) (roles []string, ok bool) {
+	if a.userInfoCache == nil || claims.Subject == "" {
+		return nil, true
+	}
+	if roles, ok := a.userInfoCache.get(claims.Subject); ok {
+		return roles, true
+	}
+	generation := a.userInfoCache.currentGeneration()
+
+	ctx, cancel := context.WithTimeout(ctx, userInfoTimeout)
+	defer cancel()
+	roles, err := a.fetchUserInfoRoles(ctx, a.keys.Load().metadata.UserinfoEndpoint, token, claims.Subject)
+	if err != nil {
+		a.logger.Warnf("Could not fetch roles from userinfo endpoint, using token roles only: %v", err)
+		return nil, false
+	}
+	a.userInfoCache.put(claims.Subject, roles, generation)
+	return roles, true
+}
+
+// fetchUserInfoRoles queries endpoint with token and returns the roles of
+// the response, found like those of tokens. The response must be about
+// subject, as required by OpenID Connect.
+func (a *KeycloakAuthenticator) fetchUserInfoRoles(ctx context.Context, endpoint string, token string, subject string) ([]string, error) {
+	client := a.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, errors.Errorf("Could not create request for %s: %v", endpoint, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("Error fetching %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error fetching %s: unexpected status %s", endpoint, resp.Status)
+	}
+
+	claims := &KeycloakClaim{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxUserInfoResponseSize)).Decode(claims); err != nil {
+		return nil, errors.Errorf("Error decoding userinfo from %s: %v", endpoint, err)
+	}
+	if claims.Subject != subject {
+		return nil, errors.Errorf("Userinfo from %s is about subject %q, expected %q", endpoint, claims.Subject, subject)
+	}
+	return a.tokenRoles(claims), nil
+}
@@ -0,0 +1,170 @@
+package authenticator
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// configError lists every problem found in a KeycloakConfig
+type configError struct {
+	problems []string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("Invalid authenticator configuration: %s", strings.Join(e.problems, "; "))
+}
+
+// validate checks config before anything is fetched, together with the
+// JWKS URLs given to a constructor. The issuer URL is required if discovery
+// is performed. All problems are reported at once.
+func (c KeycloakConfig) validate(discovery bool, jwksURLs ...string) error {
+	problems := []string{}
+	if discovery {
+		if problem := c.checkURL("issuer URL", c.IssuerURL); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for _, jwksURL := range jwksURLs {
+		if problem := c.checkURL("JWKS URL", jwksURL); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for _, scheme := range c.TokenSchemes {
+		if scheme == "" || strings.ContainsAny(scheme, " \t") {
+			problems = append(problems, fmt.Sprintf("token scheme %q is no single word", scheme))
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"leeway", c.Leeway},
+		{"max token age", c.MaxTokenAge},
+		{"min remaining TTL", c.MinRemainingTTL},
+		{"role cache TTL", c.RoleCacheTTL},
+		{"userinfo cache TTL", c.UserInfoCacheTTL},
+		{"JWKS retry initial interval", c.JWKS.RetryInitialInterval},
+		{"JWKS retry max interval", c.JWKS.RetryMaxInterval},
+		{"discovery cache max age", c.DiscoveryCacheMaxAge},
+		{"transport idle connection timeout", c.Transport.IdleConnTimeout},
+	} {
+		if d.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", d.name))
+		}
+	}
+	if _, err := parseNetworks(c.AllowedNetworks); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.TrustedProxyHops < 0 {
+		problems = append(problems, "trusted proxy hops must not be negative")
+	}
+	if c.Transport.MaxIdleConns < 0 || c.Transport.MaxIdleConnsPerHost < 0 {
+		problems = append(problems, "transport idle connection limits must not be negative")
+	}
+	if len(c.AllowedNetworks) == 0 && len(c.NetworkRestrictedRoles) > 0 {
+		problems = append(problems, "network restricted roles require allowed networks")
+	}
+	if c.TenantClaim != "" && len(c.TenantRoleMappings) == 0 {
+		problems = append(problems, "a tenant claim requires at least one tenant")
+	}
+	if c.TenantClaim == "" && len(c.TenantRoleMappings) > 0 {
+		problems = append(problems, "tenant role mappings require a tenant claim")
+	}
+	for host, audience := range c.HostAudiences {
+		if normalizeHost(host) == "" || audience == "" {
+			problems = append(problems, fmt.Sprintf("host audience mapping %q to %q must name both a host and an audience", host, audience))
+		}
+	}
+	for _, kid := range c.AllowedKIDs {
+		if kid == "" {
+			problems = append(problems, "allowed key IDs must not be empty")
+			break
+		}
+	}
+	if c.RequireEncryption && c.DecryptionKey == nil {
+		problems = append(problems, "requiring encryption requires a decryption key")
+	}
+	if c.DiscoveryCacheFile != "" && !discovery {
+		problems = append(problems, "a discovery cache file requires OIDC discovery")
+	}
+	if c.UserInfoRoles && !discovery {
+		problems = append(problems, "roles from the userinfo endpoint require OIDC discovery")
+	}
+	if c.TokenExchange != nil {
+		if !discovery {
+			problems = append(problems, "token exchange requires OIDC discovery")
+		}
+		if c.TokenExchange.ClientID == "" {
+			problems = append(problems, "token exchange requires a client ID")
+		}
+		if c.TokenExchange.RefreshBefore < 0 {
+			problems = append(problems, "token exchange refresh before must not be negative")
+		}
+	}
+	if c.JWKS.DisableRefresh && c.JWKS.RefreshInterval != 0 {
+		problems = append(problems, "a JWKS refresh interval cannot be combined with disabled refresh")
+	}
+	if c.JWKS.DisableRefresh && c.JWKS.RespectCacheHeaders {
+		problems = append(problems, "refreshing the JWKS on cache headers cannot be combined with disabled refresh")
+	}
+	if c.JWKS.DisableRefresh && c.JWKS.RetryInitialInterval != 0 {
+		problems = append(problems, "JWKS refresh retries cannot be combined with disabled refresh")
+	}
+	if c.JWKS.RetryJitter < 0 || c.JWKS.RetryJitter > 1 {
+		problems = append(problems, fmt.Sprintf("JWKS retry jitter %v is not between 0 and 1", c.JWKS.RetryJitter))
+	}
+	if c.TokenQueryParameter != "" && len(c.TokenQueryPaths) == 0 {
+		problems = append(problems, "a token query parameter requires the paths it is read for")
+	}
+	if c.TokenQueryParameter == "" && len(c.TokenQueryPaths) > 0 {
+		problems = append(problems, "token query paths require a token query parameter")
+	}
+	for _, pattern := range c.TokenQueryPaths {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			problems = append(problems, fmt.Sprintf("invalid token query path %q", pattern))
+		}
+	}
+	for _, mapping := range c.GroupMappings {
+		if problem := mapping.validate(); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for _, mapping := range c.RolePatternMappings {
+		if _, err := path.Match(mapping.Pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid role pattern %q: %v", mapping.Pattern, err))
+		}
+	}
+	if len(problems) > 0 {
+		return &configError{problems: problems}
+	}
+	return nil
+}
+
+// checkURL returns the problem of a URL fetched from, if any: it must be an
+// absolute HTTPS URL, or HTTP if AllowInsecure is set
+func (c KeycloakConfig) checkURL(name string, rawURL string) string {
+	if rawURL == "" {
+		return fmt.Sprintf("%s is required", name)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Sprintf("%s %q does not parse: %v", name, rawURL, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Sprintf("%s %q is not absolute", name, rawURL)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && c.Transport.ForceHTTP2:
+		return fmt.Sprintf("%s %q must use https to force HTTP/2", name, rawURL)
+	case u.Scheme == "http" && c.AllowInsecure:
+	case u.Scheme == "http":
+		return fmt.Sprintf("%s %q must use https, unless insecure URLs are allowed for testing", name, rawURL)
+	default:
+		return fmt.Sprintf("%s %q must use https", name, rawURL)
+	}
+	return ""
+}
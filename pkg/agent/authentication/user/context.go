@@ -0,0 +1,16 @@
+package user
+
+import "context"
+
+type contextKey struct{}
+
+// ContextWithUserInfo returns a copy of ctx carrying the given UserInfo
+func ContextWithUserInfo(ctx context.Context, userInfo *UserInfo) context.Context {
+	return context.WithValue(ctx, contextKey{}, userInfo)
+}
+
+// UserInfoFromContext returns the UserInfo stored in ctx by ContextWithUserInfo
+func UserInfoFromContext(ctx context.Context) (*UserInfo, bool) {
+	userInfo, ok := ctx.Value(contextKey{}).(*UserInfo)
+	return userInfo, ok && userInfo != nil
+}
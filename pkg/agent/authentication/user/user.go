@@ -1,6 +1,79 @@
 package user
 
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
 type UserInfo struct {
-	AuthenticationError error
-	Roles               []string
+	AuthenticationError error    `json:"-"`
+	Roles               []string `json:"roles"`
+
+	// identity of the user, empty when not known
+	Subject           string `json:"subject,omitempty"`
+	Email             string `json:"email,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+
+	// tenant the user belongs to, empty unless tenants are configured
+	Tenant string `json:"tenant,omitempty"`
+
+	// expiry of the validated token, zero if it does not expire or the user
+	// was not authenticated by a token
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// deployment specific attributes, such as a team or tenant, set by
+	// the authenticator's enrichment callback
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// validated claims of the token, nil unless the authenticator is
+	// configured to expose them; never serialized
+	Claims map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON produces a stable representation of the user: roles are
+// sorted and always an array, and the authentication error, if any, is
+// given as its message
+func (u UserInfo) MarshalJSON() ([]byte, error) {
+	roles := make([]string, len(u.Roles))
+	copy(roles, u.Roles)
+	sort.Strings(roles)
+
+	var authenticationError string
+	if u.AuthenticationError != nil {
+		authenticationError = u.AuthenticationError.Error()
+	}
+	var expiresAt *time.Time
+	if !u.ExpiresAt.IsZero() {
+		expiresAt = &u.ExpiresAt
+	}
+
+	return json.Marshal(struct {
+		AuthenticationError string            `json:"authentication_error,omitempty"`
+		Roles               []string          `json:"roles"`
+		Tenant              string            `json:"tenant,omitempty"`
+		Subject             string            `json:"subject,omitempty"`
+		Email               string            `json:"email,omitempty"`
+		PreferredUsername   string            `json:"preferred_username,omitempty"`
+		Attributes          map[string]string `json:"attributes,omitempty"`
+		ExpiresAt           *time.Time        `json:"expires_at,omitempty"`
+	}{
+		AuthenticationError: authenticationError,
+		Roles:               roles,
+		Tenant:              u.Tenant,
+		Subject:             u.Subject,
+		Email:               u.Email,
+		PreferredUsername:   u.PreferredUsername,
+		Attributes:          u.Attributes,
+		ExpiresAt:           expiresAt,
+	})
+}
+
+// String returns the JSON representation of the user, for logging
+func (u UserInfo) String() string {
+	b, err := u.MarshalJSON()
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
 }
@@ -93,7 +93,7 @@ func (a *RBACAuthorizer) authorizeAPIV1Request(r *http.Request, u *user.UserInfo
 func (a *RBACAuthorizer) AuthorizeRequest(r *http.Request, u *user.UserInfo) error {
 	// if not authenticated fail and return error
 	if u.AuthenticationError != nil {
-		return errors.Errorf("Authentication error: %v", u.AuthenticationError)
+		return errors.Wrap(u.AuthenticationError, "Authentication error")
 	}
 
 	// if not authorized fail and return error
@@ -0,0 +1,98 @@
+package authorization
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/pkg/errors"
+
+	"github.com/spiffe/tornjak/pkg/agent/authentication/user"
+)
+
+// default query of a RegoAuthorizer
+const defaultRegoQuery = "data.tornjak.authz.allow"
+
+// PolicyAuthorizer decides whether a user may perform an action on a
+// resource, for rules depending on more than the roles allowed per API
+type PolicyAuthorizer interface {
+	// Authorize reports whether u may perform action on resource
+	Authorize(ctx context.Context, u *user.UserInfo, action string, resource string) (bool, error)
+}
+
+// RegoAuthorizer evaluates an embedded Open Policy Agent policy written in
+// Rego. The query is evaluated with input
+//
+//	{"user": {...}, "action": "<action>", "resource": "<resource>"}
+//
+// where user holds the roles, subject, email, preferred_username,
+// attributes and tenant of the user; it must yield true to allow. For HTTP
+// requests, the action is the method and the resource the path.
+type RegoAuthorizer struct {
+	query rego.PreparedEvalQuery
+}
+
+var (
+	_ Authorizer       = (*RegoAuthorizer)(nil)
+	_ PolicyAuthorizer = (*RegoAuthorizer)(nil)
+)
+
+// NewRegoAuthorizer compiles policy, the source of a Rego module, and
+// prepares query, defaulting to "data.tornjak.authz.allow"
+func NewRegoAuthorizer(ctx context.Context, policy string, query string) (*RegoAuthorizer, error) {
+	if query == "" {
+		query = defaultRegoQuery
+	}
+	prepared, err := rego.New(
+		rego.Query(query),
+		rego.Module("policy.rego", policy),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return nil, errors.Errorf("Could not compile Rego policy: %v", err)
+	}
+	return &RegoAuthorizer{query: prepared}, nil
+}
+
+func (a *RegoAuthorizer) Authorize(ctx context.Context, u *user.UserInfo, action string, resource string) (bool, error) {
+	input := map[string]interface{}{
+		"user": map[string]interface{}{
+			"roles":              append([]string{}, u.Roles...),
+			"subject":            u.Subject,
+			"email":              u.Email,
+			"preferred_username": u.PreferredUsername,
+			"attributes":         u.Attributes,
+			"tenant":             u.Tenant,
+		},
+		"action":   action,
+		"resource": resource,
+	}
+	results, err := a.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return false, errors.Errorf("Could not evaluate Rego policy: %v", err)
+	}
+	// an undefined result denies
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return false, nil
+	}
+	allowed, ok := results[0].Expressions[0].Value.(bool)
+	if !ok {
+		return false, errors.Errorf("Rego policy yielded %v, expected a boolean", results[0].Expressions[0].Value)
+	}
+	return allowed, nil
+}
+
+func (a *RegoAuthorizer) AuthorizeRequest(r *http.Request, u *user.UserInfo) error {
+	// if not authenticated fail and return error
+	if u.AuthenticationError != nil {
+		return errors.Wrap(u.AuthenticationError, "Authentication error")
+	}
+
+	allowed, err := a.Authorize(r.Context(), u, r.Method, r.URL.Path)
+	if err != nil {
+		return errors.Errorf("Rego Authorization error: %v", err)
+	}
+	if !allowed {
+		return errors.New("Rego Authorization error: Unauthorized request")
+	}
+	return nil
+}